@@ -2,14 +2,19 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/airenas/go-app/pkg/goapp"
 	"github.com/airenas/rt-transcriber-wrapper/internal/db"
+	"github.com/airenas/rt-transcriber-wrapper/internal/domain"
+	"github.com/airenas/rt-transcriber-wrapper/internal/export"
 	"github.com/airenas/rt-transcriber-wrapper/internal/handlers"
+	"github.com/airenas/rt-transcriber-wrapper/internal/secure"
 	"github.com/airenas/rt-transcriber-wrapper/internal/service"
 	"github.com/labstack/gommon/color"
 )
@@ -29,38 +34,95 @@ func main() {
 	data.Port = cfg.GetInt("port")
 	data.DevMode = cfg.GetBool("devMode")
 	data.WSHandlerStatus = service.NewWSSimpleHandler(cfg.GetString("status.url"))
+	data.ExportOptions = export.DefaultOptions()
+	if v := cfg.GetInt("export.maxCueChars"); v > 0 {
+		data.ExportOptions.MaxChars = v
+	}
+	if v := cfg.GetDuration("export.maxCueDuration"); v > 0 {
+		data.ExportOptions.MaxDuration = v
+	}
 
-	dataManager, err := db.NewRedisDataManager(cfg.GetString("redis.url"), cfg.GetString("redis.encryptionKey"), cfg.GetDuration("redis.ttl"))
+	crypter, err := newCrypter(data.DevMode)
+	if err != nil {
+		goapp.Log.Fatal().Err(err).Msg("can't init crypter")
+	}
+	crypter.RejectUnbound(cfg.GetBool("redis.rejectUnbound"))
+	ttl := cfg.GetDuration("redis.ttl")
+	dataManager, err := db.NewRedisDataManager(db.RedisConfig{
+		URL:              cfg.GetString("redis.url"),
+		Addrs:            cfg.GetStringSlice("redis.addrs"),
+		MasterName:       cfg.GetString("redis.masterName"),
+		Cluster:          cfg.GetBool("redis.cluster"),
+		Username:         cfg.GetString("redis.username"),
+		Password:         cfg.GetString("redis.password"),
+		SentinelPassword: cfg.GetString("redis.sentinelPassword"),
+		DB:               cfg.GetInt("redis.db"),
+	}, crypter, db.RetentionPolicy{
+		Audio:        retention("audio", ttl),
+		Texts:        retention("texts", ttl),
+		Transcripts:  retention("transcripts", ttl),
+		Configs:      retention("configs", 0),
+		Dictionaries: retention("dictionaries", 0),
+	}, domain.Quota{
+		AudioBytes: int64(cfg.GetSizeInBytes("quota.audioBytes")),
+		Recordings: cfg.GetInt64("quota.recordings"),
+		TextBytes:  int64(cfg.GetSizeInBytes("quota.textBytes")),
+	})
 	if err != nil {
 		goapp.Log.Fatal().Err(err).Msg("can't init redis")
 	}
 	defer dataManager.Close()
+	if n, err := dataManager.MigrateKeys(ctx); err != nil {
+		goapp.Log.Error().Err(err).Msg("can't migrate keys")
+	} else if n > 0 {
+		goapp.Log.Info().Int("count", n).Msg("Migrated keys to per-user hash tags")
+	}
+	if cfg.GetBool("redis.reencrypt") {
+		go func() {
+			goapp.Log.Info().Str("key", crypter.ActiveKeyID()).Msg("Re-encrypting data")
+			n, err := dataManager.Reencrypt(ctx)
+			if err != nil {
+				goapp.Log.Error().Err(err).Msg("can't reencrypt")
+			}
+			goapp.Log.Info().Int("count", n).Msg("Re-encrypted")
+		}()
+	}
 	data.AudioManager = dataManager
 	data.ConfigManager = dataManager
 	data.TextManager = dataManager
-	trHandler := service.NewWSTranscriptionHandler(cfg.GetString("speech.url"), dataManager)
+	data.TranscriptManager = dataManager
+	data.ExpiryManager = dataManager
+	data.UsageManager = dataManager
+	data.DictionaryManager = dataManager
+	trHandler := service.NewWSTranscriptionHandler(cfg.GetString("speech.url"), dataManager, dataManager, dataManager)
 	data.WSHandlerSpeech = trHandler
-	hList, err := handlers.NewListHandler()
-	if err != nil {
-		goapp.Log.Fatal().Err(err).Msg("can't init list handler")
-	}
-
-	cleaner, err := handlers.NewCleaner()
+	registry := handlers.NewRegistry()
+	defer registry.Close()
+	registry.PartialInterval = cfg.GetDuration("partials.minInterval")
+	registry.CacheClient, registry.CacheCrypter = dataManager.Client(), crypter
+	registry.Dictionaries = dataManager
+	registry.Configs = dataManager
+	goapp.Log.Info().Dur("minInterval", registry.PartialInterval).Msg("Partials")
+	hList, err := registry.Build(pipelineStages())
 	if err != nil {
-		goapp.Log.Fatal().Err(err).Msg("can't init cleaner")
+		goapp.Log.Fatal().Err(err).Msg("can't init pipeline")
 	}
-	joiner, err := handlers.NewJoiner(cfg.GetString("joiner.url"))
-	if err != nil {
-		goapp.Log.Fatal().Err(err).Msg("can't init joiner")
+	trHandler.Profiles = map[string]service.Handler{}
+	data.Profiles = []string{service.DefaultProfile}
+	for name := range cfg.GetStringMap("profiles") {
+		var stages []*handlers.StageConfig
+		if err := cfg.UnmarshalKey("profiles."+name, &stages); err != nil {
+			goapp.Log.Fatal().Err(err).Str("profile", name).Msg("can't read profile")
+		}
+		if name == service.DefaultProfile {
+			goapp.Log.Fatal().Msg("default profile is configured by pipeline")
+		}
+		goapp.Log.Info().Str("profile", name).Msg("Pipeline profile")
+		if trHandler.Profiles[name], err = registry.Build(stages); err != nil {
+			goapp.Log.Fatal().Err(err).Str("profile", name).Msg("can't init profile")
+		}
+		data.Profiles = append(data.Profiles, name)
 	}
-	punctuator, err := handlers.NewPunctuator(cfg.GetString("punctuator.url"))
-	if err != nil {
-		goapp.Log.Fatal().Err(err).Msg("can't init punctuator")
-	}
-
-	hList.Add(cleaner)
-	hList.Add(joiner)
-	hList.Add(punctuator)
 	trHandler.Middleware = hList
 
 	doneCh, err := service.StartWebServer(data)
@@ -86,6 +148,66 @@ func main() {
 	}
 }
 
+// retention reads retention.<name>.ttl and retention.<name>.sliding, TTL defaults to def
+func retention(name string, def time.Duration) db.Retention {
+	cfg := goapp.Config
+	res := db.Retention{TTL: def, Sliding: cfg.GetBool("retention." + name + ".sliding")}
+	if cfg.IsSet("retention." + name + ".ttl") {
+		res.TTL = cfg.GetDuration("retention." + name + ".ttl")
+	}
+	return res
+}
+
+// pipelineStages reads the ordered stage list from pipeline.
+// Without it the default cleaner, joiner, punctuator pipeline is configured from joiner.url and punctuator.url
+func pipelineStages() []*handlers.StageConfig {
+	cfg := goapp.Config
+	if !cfg.IsSet("pipeline") {
+		return []*handlers.StageConfig{
+			{Name: "cleaner"},
+			{Name: "joiner", URL: cfg.GetString("joiner.url")},
+			{Name: "punctuator", URL: cfg.GetString("punctuator.url")},
+		}
+	}
+	var res []*handlers.StageConfig
+	if err := cfg.UnmarshalKey("pipeline", &res); err != nil {
+		goapp.Log.Fatal().Err(err).Msg("can't read pipeline")
+	}
+	return res
+}
+
+// newCrypter creates a keyring from redis.encryptionKeys (id -> key spec) and redis.activeKeyID.
+// The single redis.encryptionKey is added with the default ID.
+// Viper lowercases map keys, so key IDs are case insensitive.
+// See secure.ParseKey for the key spec format
+func newCrypter(devMode bool) (*secure.Crypter, error) {
+	cfg := goapp.Config
+	specs := cfg.GetStringMapString("redis.encryptionKeys")
+	if k := cfg.GetString("redis.encryptionKey"); k != "" {
+		specs[secure.DefaultKeyID] = k
+	}
+	keys := make(map[string][]byte, len(specs))
+	for id, spec := range specs {
+		key, err := secure.ParseKey(spec)
+		if err != nil {
+			return nil, fmt.Errorf("key '%s': %w", id, err)
+		}
+		if secure.IsPlaceholder(key) {
+			if !devMode {
+				return nil, fmt.Errorf("key '%s' is a placeholder, configure a real key", id)
+			}
+			goapp.Log.Warn().Str("id", id).Msg("Placeholder encryption key")
+		}
+		keys[id] = key
+	}
+	active := strings.ToLower(cfg.GetString("redis.activeKeyID"))
+	if active == "" {
+		active = secure.DefaultKeyID
+	}
+	goapp.Log.Info().Int("keys", len(keys)).Str("active", active).Msg("Crypter")
+	return secure.NewKeyring(keys, active)
+}
+
 var (
 	version = "DEV"
 )
@@ -1,9 +1,13 @@
 package api
 
+import "time"
+
 type Hypothesis struct {
 	Transcript    string          `json:"transcript"`
 	Likelihood    float64         `json:"likelihood"`
 	WordAlignment []WordAlignment `json:"word-alignment,omitempty"`
+	// Masked are the indexes of masked words in the transcript split by spaces
+	Masked []int `json:"masked,omitempty"`
 }
 
 type WordAlignment struct {
@@ -22,6 +26,7 @@ type ShortResult struct {
 	Transcript string `json:"transcript"`
 	Segment    int    `json:"segment"`
 	Final      bool   `json:"final"`
+	Masked     []int  `json:"masked,omitempty"`
 }
 
 type FullResult struct {
@@ -35,6 +40,7 @@ type FullResult struct {
 	OldUpdates      []*ShortResult `json:"old-updates,omitempty"`
 	Event           string         `json:"event,omitempty"`
 	TranscriptionID string         `json:"transcription-id,omitempty"`
+	Profile         string         `json:"profile,omitempty"`
 }
 
 type EventMsg struct {
@@ -46,10 +52,23 @@ const (
 	EventStartAuto = "START_TRANSCRIPTION_AUTO"
 	EventStop      = "STOP_TRANSCRIPTION"
 	EventStopping  = "STOPPING_TRANSCRIPTION"
+	// EventUpdate delivers corrected segment texts in OldUpdates after asynchronous processing
+	EventUpdate = "TRANSCRIPTION_UPDATE"
+	// EventQuotaExceeded is sent when the recording can't be saved because of the user quota
+	EventQuotaExceeded = "QUOTA_EXCEEDED"
 )
 
 type Config struct {
-	SkipTour bool `json:"skipTour"`
+	SkipTour bool   `json:"skipTour"`
+	Profile  string `json:"profile,omitempty"`
+	Masking  *bool  `json:"masking,omitempty"`
+}
+
+// ConfigUpdate is a partial Config, only the fields present are saved
+type ConfigUpdate struct {
+	SkipTour *bool   `json:"skipTour"`
+	Profile  *string `json:"profile"`
+	Masking  *bool   `json:"masking"`
 }
 
 type Part struct {
@@ -60,3 +79,58 @@ type Part struct {
 type Texts struct {
 	Parts []Part `json:"parts"`
 }
+
+type Order struct {
+	IDs []string `json:"ids"`
+}
+
+type TranscriptSegment struct {
+	Segment int             `json:"segment"`
+	Start   float64         `json:"start"`
+	Length  float64         `json:"length"`
+	Text    string          `json:"text"`
+	Words   []WordAlignment `json:"words,omitempty"`
+}
+
+type Transcript struct {
+	ID       string              `json:"id"`
+	Created  time.Time           `json:"created"`
+	Updated  time.Time           `json:"updated"`
+	Text     string              `json:"text"`
+	Segments []TranscriptSegment `json:"segments"`
+}
+
+type Expiry struct {
+	Type      string     `json:"type"`
+	ID        string     `json:"id,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	Sliding   bool       `json:"sliding"`
+}
+
+type Expiries struct {
+	Items []Expiry `json:"items"`
+}
+
+type UsageAmount struct {
+	AudioBytes int64 `json:"audioBytes"`
+	Recordings int64 `json:"recordings"`
+	TextBytes  int64 `json:"textBytes"`
+}
+
+// Usage reports consumed storage, limit 0 means no limit
+type Usage struct {
+	Used  UsageAmount `json:"used"`
+	Limit UsageAmount `json:"limit"`
+}
+
+type DictionaryRule struct {
+	ID           string `json:"id"`
+	From         string `json:"from"`
+	To           string `json:"to"`
+	Regex        bool   `json:"regex,omitempty"`
+	PreserveCase bool   `json:"preserveCase,omitempty"`
+}
+
+type Dictionary struct {
+	Rules []DictionaryRule `json:"rules"`
+}
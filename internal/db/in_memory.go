@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"strings"
 	"sync"
 
 	"github.com/airenas/go-app/pkg/goapp"
@@ -55,6 +56,8 @@ type MemoryDataManager struct {
 	data    map[string][]byte
 	configs map[string]*domain.User
 	texts   map[string]*domain.Texts
+	trs     map[string]*domain.Transcript
+	dicts   map[string]*domain.Dictionary
 
 	lock sync.RWMutex
 }
@@ -64,10 +67,12 @@ func NewMemoryDataManager() *MemoryDataManager {
 		data:    make(map[string][]byte),
 		configs: make(map[string]*domain.User),
 		texts:   make(map[string]*domain.Texts),
+		trs:     make(map[string]*domain.Transcript),
+		dicts:   make(map[string]*domain.Dictionary),
 	}
 }
 
-func (am *MemoryDataManager) SaveAudio(id string, chunks [][]byte) error {
+func (am *MemoryDataManager) SaveAudio(ctx context.Context, userID string, id string, chunks [][]byte) error {
 	goapp.Log.Debug().Str("id", id).Msg("Save audio")
 	am.lock.Lock()
 	defer am.lock.Unlock()
@@ -76,21 +81,21 @@ func (am *MemoryDataManager) SaveAudio(id string, chunks [][]byte) error {
 	if err != nil {
 		return fmt.Errorf("to wav: %w", err)
 	}
-	am.data[id] = res
+	am.data[userID+":"+id] = res
 	return nil
 }
 
-func (am *MemoryDataManager) GetAudio(id string) ([]byte, error) {
+func (am *MemoryDataManager) OpenAudio(ctx context.Context, userID string, id string) (io.ReadSeeker, error) {
 	goapp.Log.Debug().Str("id", id).Msg("Getting audio")
 	am.lock.RLock()
 	defer am.lock.RUnlock()
-	data, ok := am.data[id]
+	data, ok := am.data[userID+":"+id]
 	if !ok {
-		return nil, fmt.Errorf("not found")
+		return nil, domain.ErrNotFound
 	}
 	cp := make([]byte, len(data))
 	copy(cp, data)
-	return cp, nil
+	return bytes.NewReader(cp), nil
 }
 
 // GetConfig implements ConfigManager.
@@ -135,6 +140,117 @@ func (am *MemoryDataManager) SaveTexts(ctx context.Context, userID string, input
 	return nil
 }
 
+// UpdateTexts implements TextManager.
+func (am *MemoryDataManager) UpdateTexts(ctx context.Context, userID string, update func(*domain.Texts) error) (*domain.Texts, error) {
+	am.lock.Lock()
+	defer am.lock.Unlock()
+
+	res := &domain.Texts{}
+	if data, ok := am.texts[userID]; ok {
+		res.Parts = append(res.Parts, data.Parts...)
+	}
+	if err := update(res); err != nil {
+		return nil, err
+	}
+	am.texts[userID] = res
+	return res, nil
+}
+
+// GetDictionary implements DictionaryManager.
+func (am *MemoryDataManager) GetDictionary(ctx context.Context, userID string) (*domain.Dictionary, error) {
+	am.lock.RLock()
+	defer am.lock.RUnlock()
+
+	res := &domain.Dictionary{}
+	if data, ok := am.dicts[userID]; ok {
+		res.Rules = append(res.Rules, data.Rules...)
+	}
+	return res, nil
+}
+
+// UpdateDictionary implements DictionaryManager.
+func (am *MemoryDataManager) UpdateDictionary(ctx context.Context, userID string, update func(*domain.Dictionary) error) (*domain.Dictionary, error) {
+	am.lock.Lock()
+	defer am.lock.Unlock()
+
+	res := &domain.Dictionary{}
+	if data, ok := am.dicts[userID]; ok {
+		res.Rules = append(res.Rules, data.Rules...)
+	}
+	if err := update(res); err != nil {
+		return nil, err
+	}
+	am.dicts[userID] = res
+	return res, nil
+}
+
+// SaveTranscript implements TranscriptManager.
+func (am *MemoryDataManager) SaveTranscript(ctx context.Context, userID string, transcript *domain.Transcript) error {
+	am.lock.Lock()
+	defer am.lock.Unlock()
+
+	cp := *transcript
+	cp.Segments = append([]domain.TranscriptSegment(nil), transcript.Segments...)
+	am.trs[userID+":"+transcript.ID] = &cp
+	return nil
+}
+
+// GetTranscript implements TranscriptManager.
+func (am *MemoryDataManager) GetTranscript(ctx context.Context, userID string, id string) (*domain.Transcript, error) {
+	am.lock.RLock()
+	defer am.lock.RUnlock()
+
+	data, ok := am.trs[userID+":"+id]
+	if !ok {
+		return nil, domain.ErrNotFound
+	}
+	cp := *data
+	return &cp, nil
+}
+
+// GetExpiry implements ExpiryManager, memory data never expires.
+func (am *MemoryDataManager) GetExpiry(ctx context.Context, userID string) ([]*domain.Expiry, error) {
+	am.lock.RLock()
+	defer am.lock.RUnlock()
+
+	var res []*domain.Expiry
+	if _, ok := am.configs[userID]; ok {
+		res = append(res, &domain.Expiry{Type: "config"})
+	}
+	if _, ok := am.texts[userID]; ok {
+		res = append(res, &domain.Expiry{Type: "texts"})
+	}
+	for k := range am.data {
+		if id, ok := strings.CutPrefix(k, userID+":"); ok {
+			res = append(res, &domain.Expiry{Type: "audio", ID: id})
+		}
+	}
+	for k := range am.trs {
+		if id, ok := strings.CutPrefix(k, userID+":"); ok {
+			res = append(res, &domain.Expiry{Type: "transcript", ID: id})
+		}
+	}
+	return res, nil
+}
+
+// GetUsage implements UsageManager, memory storage has no limits.
+func (am *MemoryDataManager) GetUsage(ctx context.Context, userID string) (*domain.Usage, error) {
+	am.lock.RLock()
+	defer am.lock.RUnlock()
+
+	res := &domain.Usage{}
+	for k, v := range am.data {
+		if strings.HasPrefix(k, userID+":") {
+			res.Used.Recordings++
+			res.Used.AudioBytes += int64(len(v))
+		}
+	}
+	if t, ok := am.texts[userID]; ok {
+		res.Used.TextBytes = t.Size()
+	}
+	return res, nil
+}
+
 func to_wav(chunks [][]byte) ([]byte, error) {
 	var pcmData bytes.Buffer
 	for _, chunk := range chunks {
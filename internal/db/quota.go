@@ -0,0 +1,138 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/airenas/rt-transcriber-wrapper/internal/domain"
+	"github.com/redis/go-redis/v9"
+)
+
+// saveAudioScript stores the audio and registers it in the user audio set atomically if the quota allows.
+// The set keeps members '<id>:<size>' scored by the expiry time in ms, expired members are dropped first.
+//
+//	KEYS: audio key, quota key
+//	ARGV: data, ttl ms (0 - no expiry), now ms, id, size, max bytes, max recordings
+var saveAudioScript = redis.NewScript(`
+local ttl, now, size = tonumber(ARGV[2]), tonumber(ARGV[3]), tonumber(ARGV[5])
+local maxBytes, maxCount = tonumber(ARGV[6]), tonumber(ARGV[7])
+redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', '(' .. now)
+local count, bytes = 0, 0
+for _, m in ipairs(redis.call('ZRANGE', KEYS[2], 0, -1)) do
+	local id, s = string.match(m, '^(.*):(%d+)$')
+	if id == ARGV[4] then
+		redis.call('ZREM', KEYS[2], m)
+	else
+		count = count + 1
+		bytes = bytes + tonumber(s)
+	end
+end
+if (maxCount > 0 and count + 1 > maxCount) or (maxBytes > 0 and bytes + size > maxBytes) then
+	return 0
+end
+local quotaTTL = redis.call('PTTL', KEYS[2])
+local member = ARGV[4] .. ':' .. ARGV[5]
+if ttl > 0 then
+	redis.call('SET', KEYS[1], ARGV[1], 'PX', ttl)
+	redis.call('ZADD', KEYS[2], now + ttl, member)
+	if quotaTTL ~= -1 and quotaTTL < ttl then
+		redis.call('PEXPIRE', KEYS[2], ttl)
+	end
+else
+	redis.call('SET', KEYS[1], ARGV[1])
+	redis.call('ZADD', KEYS[2], '+inf', member)
+	redis.call('PERSIST', KEYS[2])
+end
+return 1
+`)
+
+// refreshAudioScript moves the expiry of a registered audio for sliding retention
+//
+//	KEYS: quota key
+//	ARGV: ttl ms, now ms, id
+var refreshAudioScript = redis.NewScript(`
+local ttl, now = tonumber(ARGV[1]), tonumber(ARGV[2])
+for _, m in ipairs(redis.call('ZRANGE', KEYS[1], 0, -1)) do
+	local id = string.match(m, '^(.*):%d+$')
+	if id == ARGV[3] then
+		redis.call('ZADD', KEYS[1], 'XX', now + ttl, m)
+		local quotaTTL = redis.call('PTTL', KEYS[1])
+		if quotaTTL ~= -1 and quotaTTL < ttl then
+			redis.call('PEXPIRE', KEYS[1], ttl)
+		end
+		return 1
+	end
+end
+return 0
+`)
+
+// keyQuota is a sorted set of user recordings with their sizes, it shares the hash tag with the user data
+func keyQuota(userID string) string {
+	return fmt.Sprintf("quota:{%s}:audio", userID)
+}
+
+func (r *RedisDataManager) setAudio(ctx context.Context, key dataKey, data []byte) error {
+	ttl := r.ttl(key)
+	ok, err := saveAudioScript.Run(ctx, r.client, []string{key.redis, keyQuota(key.User)},
+		data, ttl.Milliseconds(), time.Now().UnixMilli(), audioID(key), len(data),
+		r.quota.AudioBytes, r.quota.Recordings).Int()
+	if err != nil {
+		return err
+	}
+	if ok == 0 {
+		return fmt.Errorf("audio of %d bytes: %w", len(data), domain.ErrQuotaExceeded)
+	}
+	return nil
+}
+
+func (r *RedisDataManager) refreshAudio(ctx context.Context, key dataKey, ttl time.Duration) error {
+	return refreshAudioScript.Run(ctx, r.client, []string{keyQuota(key.User)},
+		ttl.Milliseconds(), time.Now().UnixMilli(), audioID(key)).Err()
+}
+
+func audioID(key dataKey) string {
+	return key.redis[strings.LastIndex(key.redis, ":")+1:]
+}
+
+func (r *RedisDataManager) checkTexts(t *domain.Texts) error {
+	if size := t.Size(); (domain.Quota{TextBytes: size}).Exceeds(r.quota) {
+		return fmt.Errorf("texts of %d bytes: %w", size, domain.ErrQuotaExceeded)
+	}
+	return nil
+}
+
+// GetUsage reports the storage used by the user.
+// Audio saved before quotas were introduced is not counted
+func (r *RedisDataManager) GetUsage(ctx context.Context, userID string) (*domain.Usage, error) {
+	var members *redis.StringSliceCmd
+	var texts *redis.StringCmd
+	key := r.keyTexts(userID)
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRemRangeByScore(ctx, keyQuota(userID), "-inf", "("+strconv.FormatInt(time.Now().UnixMilli(), 10))
+		members = pipe.ZRange(ctx, keyQuota(userID), 0, -1)
+		texts = pipe.Get(ctx, key.redis)
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("get usage: %w", err)
+	}
+	res := &domain.Usage{Limit: r.quota}
+	for _, m := range members.Val() {
+		i := strings.LastIndex(m, ":")
+		size, err := strconv.ParseInt(m[i+1:], 10, 64)
+		if i < 0 || err != nil {
+			return nil, fmt.Errorf("wrong quota member '%s'", m)
+		}
+		res.Used.Recordings++
+		res.Used.AudioBytes += size
+	}
+	t, err := r.decodeTexts(texts, key)
+	if err != nil {
+		return nil, err
+	}
+	res.Used.TextBytes = t.Size()
+	return res, nil
+}
@@ -1,9 +1,13 @@
 package db
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"strings"
 	"time"
 
 	"github.com/airenas/go-app/pkg/goapp"
@@ -12,83 +16,337 @@ import (
 	"github.com/redis/go-redis/v9"
 )
 
+const maxTxRetries = 10
+
+// dataPatterns match all encrypted keys
+var dataPatterns = []string{"audio:*", "user:*", "texts:*", "transcript:*", "dictionary:*"}
+
+// RedisConfig describes a single node, sentinel or cluster connection.
+// URL is used for a single node, otherwise Addrs with MasterName for sentinel
+// or Addrs with Cluster for cluster mode
+type RedisConfig struct {
+	URL              string
+	Addrs            []string
+	MasterName       string
+	Cluster          bool
+	Username         string
+	Password         string
+	SentinelPassword string
+	DB               int
+}
+
 // RedisDataManager stores audio, user configs, and texts in Redis.
+// All keys of a user share a hash tag, so they live in the same cluster slot
 type RedisDataManager struct {
-	client  *redis.Client
-	ttl     time.Duration
-	crypter *secure.Crypter
+	client    redis.UniversalClient
+	retention RetentionPolicy
+	quota     domain.Quota
+	crypter   *secure.Crypter
 }
 
 // NewRedisDataManager creates a new RedisDataManager with connection pooling.
-func NewRedisDataManager(connStr string, encryptionKey string, ttl time.Duration) (*RedisDataManager, error) {
-	opt, err := redis.ParseURL(connStr)
+// Quota limits are per user, 0 means no limit
+func NewRedisDataManager(cfg RedisConfig, crypter *secure.Crypter, retention RetentionPolicy, quota domain.Quota) (*RedisDataManager, error) {
+	opt, err := universalOptions(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("parse redis URL: %w", err)
+		return nil, err
 	}
-	goapp.Log.Info().Str("redis", opt.Addr).Int("db", opt.DB).Dur("ttl", ttl).Send()
-	rdb := redis.NewClient(opt)
+	rdb := redis.NewUniversalClient(opt)
+	goapp.Log.Info().Strs("redis", opt.Addrs).Str("mode", mode(rdb)).Str("master", opt.MasterName).Int("db", opt.DB).
+		Interface("retention", retention).Interface("quota", quota).Send()
 
-	crypter, err := secure.NewCrypter(encryptionKey)
-	if err != nil {
-		return nil, fmt.Errorf("create crypter: %w", err)
+	if crypter == nil {
+		return nil, fmt.Errorf("no crypter")
+	}
+
+	if err := retention.validate(); err != nil {
+		return nil, err
+	}
+
+	res := &RedisDataManager{
+		client:    rdb,
+		retention: retention,
+		quota:     quota,
+		crypter:   crypter,
+	}
+	ctx, cf := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cf()
+	if err := res.Health(ctx); err != nil {
+		goapp.Log.Error().Err(err).Msg("redis is not healthy")
+	} else {
+		goapp.Log.Info().Msg("redis is healthy")
+	}
+	return res, nil
+}
+
+func universalOptions(cfg RedisConfig) (*redis.UniversalOptions, error) {
+	if len(cfg.Addrs) == 0 {
+		opt, err := redis.ParseURL(cfg.URL)
+		if err != nil {
+			return nil, fmt.Errorf("parse redis URL: %w", err)
+		}
+		return &redis.UniversalOptions{Addrs: []string{opt.Addr}, DB: opt.DB, Username: opt.Username,
+			Password: opt.Password, TLSConfig: opt.TLSConfig}, nil
+	}
+	if cfg.Cluster && cfg.MasterName != "" {
+		return nil, fmt.Errorf("cluster and sentinel master name can't be used together")
+	}
+	if cfg.Cluster && cfg.DB != 0 {
+		return nil, fmt.Errorf("cluster supports only db 0")
+	}
+	return &redis.UniversalOptions{Addrs: cfg.Addrs, MasterName: cfg.MasterName, IsClusterMode: cfg.Cluster,
+		Username: cfg.Username, Password: cfg.Password, SentinelPassword: cfg.SentinelPassword, DB: cfg.DB}, nil
+}
+
+func mode(client redis.UniversalClient) string {
+	switch client.(type) {
+	case *redis.ClusterClient:
+		return "cluster"
+	case *redis.Client:
+		return "single/sentinel"
+	}
+	return "unknown"
+}
+
+// Health pings redis, every shard in cluster mode
+func (r *RedisDataManager) Health(ctx context.Context) error {
+	if cc, ok := r.client.(*redis.ClusterClient); ok {
+		return cc.ForEachShard(ctx, func(ctx context.Context, c *redis.Client) error {
+			return c.Ping(ctx).Err()
+		})
 	}
+	return r.client.Ping(ctx).Err()
+}
 
-	if ttl <= 5*time.Minute {
-		return nil, fmt.Errorf("TTL is set to a low value of %s, it should be at least 5 minutes", ttl)
+// scan calls f for every key matching the pattern, on every master in cluster mode
+func (r *RedisDataManager) scan(ctx context.Context, pattern string, f func(key string)) error {
+	scanOne := func(ctx context.Context, c redis.Cmdable) error {
+		iter := c.Scan(ctx, 0, pattern, 100).Iterator()
+		for iter.Next(ctx) {
+			f(iter.Val())
+		}
+		return iter.Err()
 	}
+	if cc, ok := r.client.(*redis.ClusterClient); ok {
+		return cc.ForEachMaster(ctx, func(ctx context.Context, c *redis.Client) error {
+			return scanOne(ctx, c)
+		})
+	}
+	return scanOne(ctx, r.client)
+}
+
+// data types used to bind ciphertexts
+const (
+	typeAudio      = "audio"
+	typeConfig     = "config"
+	typeTexts      = "texts"
+	typeTranscript = "transcript"
+	typeDictionary = "dictionary"
+)
+
+// dataKey keeps the redis key and the binding for encryption.
+// The binding uses a logical key that does not depend on the hash tag layout
+type dataKey struct {
+	secure.Binding
+	redis string
+}
 
-	return &RedisDataManager{
-		client:  rdb,
-		ttl:     ttl,
-		crypter: crypter,
-	}, nil
+func (r *RedisDataManager) keyAudio(userID, id string) dataKey {
+	return dataKey{Binding: secure.Binding{Type: typeAudio, User: userID, Key: fmt.Sprintf("audio:audio-%s-%s", userID, id)},
+		redis: fmt.Sprintf("audio:{%s}:%s", userID, id)}
 }
 
-func (r *RedisDataManager) keyAudio(id string) string {
-	return fmt.Sprintf("audio:%s", id)
+func (r *RedisDataManager) keyConfig(userID string) dataKey {
+	return dataKey{Binding: secure.Binding{Type: typeConfig, User: userID, Key: fmt.Sprintf("user:%s", userID)},
+		redis: fmt.Sprintf("user:{%s}", userID)}
 }
 
-func (r *RedisDataManager) keyConfig(id string) string {
-	return fmt.Sprintf("user:%s", id)
+func (r *RedisDataManager) keyTexts(userID string) dataKey {
+	return dataKey{Binding: secure.Binding{Type: typeTexts, User: userID, Key: fmt.Sprintf("texts:%s", userID)},
+		redis: fmt.Sprintf("texts:{%s}", userID)}
 }
 
-func (r *RedisDataManager) keyTexts(id string) string {
-	return fmt.Sprintf("texts:%s", id)
+func (r *RedisDataManager) keyTranscript(userID, id string) dataKey {
+	return dataKey{Binding: secure.Binding{Type: typeTranscript, User: userID, Key: fmt.Sprintf("transcript:%s:%s", userID, id)},
+		redis: fmt.Sprintf("transcript:{%s}:%s", userID, id)}
 }
 
-// SaveAudio stores WAV bytes in Redis
-func (r *RedisDataManager) SaveAudio(ctx context.Context, id string, chunks [][]byte) error {
+func (r *RedisDataManager) keyDictionary(userID string) dataKey {
+	return dataKey{Binding: secure.Binding{Type: typeDictionary, User: userID, Key: fmt.Sprintf("dictionary:%s", userID)},
+		redis: fmt.Sprintf("dictionary:{%s}", userID)}
+}
+
+// keyOf restores the key from a stored redis key
+func (r *RedisDataManager) keyOf(key string) (dataKey, bool) {
+	if user, id, ok := cutKey(key, "audio:{", "}:"); ok {
+		return r.keyAudio(user, id), true
+	}
+	if user, ok := cutTagged(key, "user:{"); ok {
+		return r.keyConfig(user), true
+	}
+	if user, ok := cutTagged(key, "texts:{"); ok {
+		return r.keyTexts(user), true
+	}
+	if user, id, ok := cutKey(key, "transcript:{", "}:"); ok {
+		return r.keyTranscript(user, id), true
+	}
+	if user, ok := cutTagged(key, "dictionary:{"); ok {
+		return r.keyDictionary(user), true
+	}
+	return dataKey{}, false
+}
+
+// legacyKeyOf restores the key from a redis key stored before hash tags were introduced
+func (r *RedisDataManager) legacyKeyOf(key string) (dataKey, bool) {
+	if _, ok := r.keyOf(key); ok {
+		return dataKey{}, false
+	}
+	if user, id, ok := cutKey(key, "audio:audio-", "-"); ok {
+		return r.keyAudio(user, id), true
+	}
+	if user, ok := strings.CutPrefix(key, "user:"); ok && user != "" {
+		return r.keyConfig(user), true
+	}
+	if user, ok := strings.CutPrefix(key, "texts:"); ok && user != "" {
+		return r.keyTexts(user), true
+	}
+	if user, id, ok := cutKey(key, "transcript:", ":"); ok {
+		return r.keyTranscript(user, id), true
+	}
+	return dataKey{}, false
+}
+
+// cutKey splits a key into the user and the record ID at the last separator,
+// record IDs are ULIDs, so they never contain separators
+func cutKey(key, prefix, sep string) (string, string, bool) {
+	rest, ok := strings.CutPrefix(key, prefix)
+	if !ok {
+		return "", "", false
+	}
+	i := strings.LastIndex(rest, sep)
+	if i <= 0 || i+len(sep) == len(rest) {
+		return "", "", false
+	}
+	return rest[:i], rest[i+len(sep):], true
+}
+
+func cutTagged(key, prefix string) (string, bool) {
+	rest, ok := strings.CutPrefix(key, prefix)
+	if !ok {
+		return "", false
+	}
+	user, ok := strings.CutSuffix(rest, "}")
+	return user, ok && user != ""
+}
+
+func (r *RedisDataManager) ttl(key dataKey) time.Duration {
+	return r.retention.of(key.Type).TTL
+}
+
+// get reads the value and refreshes its TTL for sliding retention
+func (r *RedisDataManager) get(ctx context.Context, key dataKey) *redis.StringCmd {
+	if ret := r.retention.of(key.Type); ret.Sliding && ret.TTL > 0 {
+		return r.client.GetEx(ctx, key.redis, ret.TTL)
+	}
+	return r.client.Get(ctx, key.redis)
+}
+
+// refresh extends TTL of the key for sliding retention
+func (r *RedisDataManager) refresh(ctx context.Context, key dataKey) error {
+	if ret := r.retention.of(key.Type); ret.Sliding && ret.TTL > 0 {
+		if err := r.client.Expire(ctx, key.redis, ret.TTL).Err(); err != nil {
+			return err
+		}
+		if key.Type == typeAudio {
+			return r.refreshAudio(ctx, key, ret.TTL)
+		}
+	}
+	return nil
+}
+
+// SaveAudio stores WAV bytes in Redis, returns domain.ErrQuotaExceeded if the user quota does not allow it
+func (r *RedisDataManager) SaveAudio(ctx context.Context, userID string, id string, chunks [][]byte) error {
 	goapp.Log.Trace().Str("id", id).Msg("Save audio")
 
 	data, err := to_wav(chunks)
 	if err != nil {
 		return fmt.Errorf("convert to wav: %w", err)
 	}
-	encrypted, err := r.crypter.Encrypt(data)
+	key := r.keyAudio(userID, id)
+	encrypted, err := r.crypter.EncryptStream(data, key.Binding)
 	if err != nil {
 		return fmt.Errorf("encrypt: %w", err)
 	}
-
-	key := r.keyAudio(id)
-	return r.client.Set(ctx, key, encrypted, r.ttl).Err()
+	return r.setAudio(ctx, key, encrypted)
 }
 
-// GetAudio retrieves WAV bytes from Redis
-func (r *RedisDataManager) GetAudio(ctx context.Context, id string) ([]byte, error) {
-	goapp.Log.Trace().Str("id", id).Msg("Get audio")
-	key := r.keyAudio(id)
-	b, err := r.client.Get(ctx, key).Bytes()
+// OpenAudio returns a reader of WAV bytes. Stream encrypted audio is read from Redis
+// by segments on demand, so a range request does not decrypt the whole file
+func (r *RedisDataManager) OpenAudio(ctx context.Context, userID string, id string) (io.ReadSeeker, error) {
+	goapp.Log.Trace().Str("id", id).Msg("Open audio")
+	key := r.keyAudio(userID, id)
+	size, err := r.client.StrLen(ctx, key.redis).Result()
 	if err != nil {
-		if err == redis.Nil {
-			return nil, fmt.Errorf("not found")
+		return nil, fmt.Errorf("get audio size: %w", err)
+	}
+	if size == 0 {
+		return nil, domain.ErrNotFound
+	}
+	if err := r.refresh(ctx, key); err != nil {
+		return nil, fmt.Errorf("refresh audio TTL: %w", err)
+	}
+	return openAudio(r.crypter, &redisReaderAt{ctx: ctx, client: r.client, key: key.redis}, size, key.Binding)
+}
+
+// openAudio decrypts stream audio by segments and older formats as a whole.
+// A legacy ciphertext starts with a random nonce, so it is tried if the data only looks like a stream
+func openAudio(crypter *secure.Crypter, ra io.ReaderAt, size int64, b secure.Binding) (io.ReadSeeker, error) {
+	start := make([]byte, 1)
+	if _, err := ra.ReadAt(start, 0); err != nil {
+		return nil, fmt.Errorf("read audio: %w", err)
+	}
+	var errStream error
+	if secure.IsStream(start) {
+		sr, err := crypter.NewStreamReaderAt(ra, size, b)
+		if err == nil {
+			return io.NewSectionReader(sr, 0, sr.Size()), nil
 		}
-		return nil, err
+		errStream = err
+	}
+	data := make([]byte, size)
+	if _, err := ra.ReadAt(data, 0); err != nil {
+		return nil, fmt.Errorf("read audio: %w", err)
 	}
-	decrypted, err := r.crypter.Decrypt(b)
+	decrypted, err := crypter.DecryptFor(data, b)
 	if err != nil {
+		if errStream != nil {
+			err = errStream
+		}
 		return nil, fmt.Errorf("decrypt: %w", err)
 	}
-	return decrypted, nil
+	return bytes.NewReader(decrypted), nil
+}
+
+// redisReaderAt reads parts of a string value with GETRANGE
+type redisReaderAt struct {
+	ctx    context.Context
+	client redis.UniversalClient
+	key    string
+}
+
+func (r *redisReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	res, err := r.client.GetRange(r.ctx, r.key, off, off+int64(len(p))-1).Bytes()
+	if err != nil {
+		return 0, err
+	}
+	n := copy(p, res)
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
 }
 
 // SaveConfig stores user config in Redis as JSON
@@ -98,24 +356,24 @@ func (r *RedisDataManager) SaveConfig(ctx context.Context, user *domain.User) er
 	if err != nil {
 		return err
 	}
-	encrypted, err := r.crypter.Encrypt(data)
+	encrypted, err := r.crypter.EncryptFor(data, key.Binding)
 	if err != nil {
 		return fmt.Errorf("encrypt: %w", err)
 	}
-	return r.client.Set(ctx, key, encrypted, 0).Err()
+	return r.client.Set(ctx, key.redis, encrypted, r.ttl(key)).Err()
 }
 
 // GetConfig retrieves user config from Redis
 func (r *RedisDataManager) GetConfig(ctx context.Context, userID string) (*domain.User, error) {
 	key := r.keyConfig(userID)
-	bs, err := r.client.Get(ctx, key).Bytes()
+	bs, err := r.get(ctx, key).Bytes()
 	if err != nil {
 		if err == redis.Nil {
 			return &domain.User{ID: userID}, nil
 		}
 		return nil, fmt.Errorf("get config: %w", err)
 	}
-	decrypted, err := r.crypter.Decrypt(bs)
+	decrypted, err := r.crypter.DecryptFor(bs, key.Binding)
 	if err != nil {
 		return nil, fmt.Errorf("decrypt: %w", err)
 	}
@@ -128,29 +386,88 @@ func (r *RedisDataManager) GetConfig(ctx context.Context, userID string) (*domai
 
 // SaveTexts stores Texts in Redis as JSON
 func (r *RedisDataManager) SaveTexts(ctx context.Context, userID string, input *domain.Texts) error {
+	if err := r.checkTexts(input); err != nil {
+		return err
+	}
 	key := r.keyTexts(userID)
 	data, err := json.Marshal(input)
 	if err != nil {
 		return err
 	}
-	encrypted, err := r.crypter.Encrypt(data)
+	encrypted, err := r.crypter.EncryptFor(data, key.Binding)
 	if err != nil {
 		return fmt.Errorf("encrypt: %w", err)
 	}
-	return r.client.Set(ctx, key, encrypted, r.ttl).Err()
+	return r.client.Set(ctx, key.redis, encrypted, r.ttl(key)).Err()
 }
 
 // GetTexts retrieves Texts from Redis
 func (r *RedisDataManager) GetTexts(ctx context.Context, userID string) (*domain.Texts, error) {
 	key := r.keyTexts(userID)
-	bs, err := r.client.Get(ctx, key).Bytes()
+	return r.decodeTexts(r.get(ctx, key), key)
+}
+
+// UpdateTexts atomically loads, modifies and stores user Texts.
+// The update is retried if the key is changed concurrently.
+func (r *RedisDataManager) UpdateTexts(ctx context.Context, userID string, update func(*domain.Texts) error) (*domain.Texts, error) {
+	key := r.keyTexts(userID)
+	var res *domain.Texts
+	txf := func(tx *redis.Tx) error {
+		t, err := r.decodeTexts(tx.Get(ctx, key.redis), key)
+		if err != nil {
+			return err
+		}
+		if err := update(t); err != nil {
+			return err
+		}
+		if err := r.checkTexts(t); err != nil {
+			return err
+		}
+		data, err := json.Marshal(t)
+		if err != nil {
+			return err
+		}
+		encrypted, err := r.crypter.EncryptFor(data, key.Binding)
+		if err != nil {
+			return fmt.Errorf("encrypt: %w", err)
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key.redis, encrypted, r.ttl(key))
+			return nil
+		})
+		res = t
+		return err
+	}
+	if err := r.watch(ctx, key, txf); err != nil {
+		return nil, fmt.Errorf("update texts: %w", err)
+	}
+	return res, nil
+}
+
+// watch runs the transaction, retrying it if the key is changed concurrently
+func (r *RedisDataManager) watch(ctx context.Context, key dataKey, txf func(tx *redis.Tx) error) error {
+	for i := 0; i < maxTxRetries; i++ {
+		err := r.client.Watch(ctx, txf, key.redis)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+		goapp.Log.Debug().Str("key", key.redis).Int("try", i).Msg("concurrent update, retry")
+	}
+	return fmt.Errorf("too many concurrent updates")
+}
+
+func (r *RedisDataManager) decodeTexts(cmd *redis.StringCmd, key dataKey) (*domain.Texts, error) {
+	bs, err := cmd.Bytes()
 	if err != nil {
 		if err == redis.Nil {
 			return &domain.Texts{}, nil
 		}
 		return nil, fmt.Errorf("get texts: %w", err)
 	}
-	decrypted, err := r.crypter.Decrypt(bs)
+	decrypted, err := r.crypter.DecryptFor(bs, key.Binding)
 	if err != nil {
 		return nil, fmt.Errorf("decrypt: %w", err)
 	}
@@ -161,6 +478,255 @@ func (r *RedisDataManager) GetTexts(ctx context.Context, userID string) (*domain
 	return &t, nil
 }
 
+// GetDictionary retrieves the user replacement rules from Redis
+func (r *RedisDataManager) GetDictionary(ctx context.Context, userID string) (*domain.Dictionary, error) {
+	key := r.keyDictionary(userID)
+	return r.decodeDictionary(r.get(ctx, key), key)
+}
+
+// UpdateDictionary atomically loads, modifies and stores the user replacement rules
+func (r *RedisDataManager) UpdateDictionary(ctx context.Context, userID string, update func(*domain.Dictionary) error) (*domain.Dictionary, error) {
+	key := r.keyDictionary(userID)
+	var res *domain.Dictionary
+	txf := func(tx *redis.Tx) error {
+		d, err := r.decodeDictionary(tx.Get(ctx, key.redis), key)
+		if err != nil {
+			return err
+		}
+		if err := update(d); err != nil {
+			return err
+		}
+		data, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		encrypted, err := r.crypter.EncryptFor(data, key.Binding)
+		if err != nil {
+			return fmt.Errorf("encrypt: %w", err)
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key.redis, encrypted, r.ttl(key))
+			return nil
+		})
+		res = d
+		return err
+	}
+	if err := r.watch(ctx, key, txf); err != nil {
+		return nil, fmt.Errorf("update dictionary: %w", err)
+	}
+	return res, nil
+}
+
+func (r *RedisDataManager) decodeDictionary(cmd *redis.StringCmd, key dataKey) (*domain.Dictionary, error) {
+	bs, err := cmd.Bytes()
+	if err != nil {
+		if err == redis.Nil {
+			return &domain.Dictionary{}, nil
+		}
+		return nil, fmt.Errorf("get dictionary: %w", err)
+	}
+	decrypted, err := r.crypter.DecryptFor(bs, key.Binding)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt: %w", err)
+	}
+	var d domain.Dictionary
+	if err := json.Unmarshal(decrypted, &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// SaveTranscript stores a transcript record in Redis as JSON
+func (r *RedisDataManager) SaveTranscript(ctx context.Context, userID string, transcript *domain.Transcript) error {
+	key := r.keyTranscript(userID, transcript.ID)
+	data, err := json.Marshal(transcript)
+	if err != nil {
+		return err
+	}
+	encrypted, err := r.crypter.EncryptFor(data, key.Binding)
+	if err != nil {
+		return fmt.Errorf("encrypt: %w", err)
+	}
+	return r.client.Set(ctx, key.redis, encrypted, r.ttl(key)).Err()
+}
+
+// GetTranscript retrieves a transcript record from Redis
+func (r *RedisDataManager) GetTranscript(ctx context.Context, userID string, id string) (*domain.Transcript, error) {
+	key := r.keyTranscript(userID, id)
+	bs, err := r.get(ctx, key).Bytes()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, domain.ErrNotFound
+		}
+		return nil, fmt.Errorf("get transcript: %w", err)
+	}
+	decrypted, err := r.crypter.DecryptFor(bs, key.Binding)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt: %w", err)
+	}
+	var t domain.Transcript
+	if err := json.Unmarshal(decrypted, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// Reencrypt walks all stored keys and re-encrypts values that are not encrypted with the active key
+// or are not bound to the user and key yet. TTL of the keys is preserved. Returns the number of updated keys
+func (r *RedisDataManager) Reencrypt(ctx context.Context) (int, error) {
+	res := 0
+	for _, pattern := range dataPatterns {
+		err := r.scan(ctx, pattern, func(key string) {
+			changed, err := r.reencryptKey(ctx, key)
+			if err != nil {
+				goapp.Log.Error().Err(err).Str("key", key).Msg("can't reencrypt")
+				return
+			}
+			if changed {
+				res++
+			}
+		})
+		if err != nil {
+			return res, fmt.Errorf("scan %s: %w", pattern, err)
+		}
+	}
+	return res, nil
+}
+
+func (r *RedisDataManager) reencryptKey(ctx context.Context, key string) (bool, error) {
+	dk, ok := r.keyOf(key)
+	if !ok {
+		if _, legacy := r.legacyKeyOf(key); legacy {
+			return false, nil // MigrateKeys renames it first
+		}
+		return false, fmt.Errorf("unknown key format")
+	}
+	b := dk.Binding
+	changed := false
+	err := r.client.Watch(ctx, func(tx *redis.Tx) error {
+		bs, err := tx.Get(ctx, key).Bytes()
+		if err != nil {
+			if err == redis.Nil {
+				return nil
+			}
+			return err
+		}
+		reencrypt := r.crypter.Reencrypt
+		if b.Type == typeAudio {
+			reencrypt = r.crypter.ReencryptStream
+		}
+		data, needed, err := reencrypt(bs, b)
+		if err != nil || !needed {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.SetArgs(ctx, key, data, redis.SetArgs{KeepTTL: true})
+			return nil
+		})
+		changed = err == nil
+		return err
+	}, key)
+	if errors.Is(err, redis.TxFailedErr) {
+		// the key was changed concurrently, so it is already written with the active key
+		return false, nil
+	}
+	return changed, err
+}
+
+// MigrateKeys renames keys stored without hash tags to the current layout.
+// Existing new keys are never overwritten. Returns the number of renamed keys.
+// Cluster deployments never had the old layout, so nothing is done there
+func (r *RedisDataManager) MigrateKeys(ctx context.Context) (int, error) {
+	if _, ok := r.client.(*redis.ClusterClient); ok {
+		return 0, nil
+	}
+	res := 0
+	for _, pattern := range dataPatterns {
+		err := r.scan(ctx, pattern, func(key string) {
+			dk, ok := r.legacyKeyOf(key)
+			if !ok {
+				return
+			}
+			renamed, err := r.client.RenameNX(ctx, key, dk.redis).Result()
+			if err != nil {
+				goapp.Log.Error().Err(err).Str("key", key).Msg("can't rename")
+				return
+			}
+			if !renamed {
+				goapp.Log.Warn().Str("key", key).Str("to", dk.redis).Msg("new key exists, old one left")
+				return
+			}
+			res++
+		})
+		if err != nil {
+			return res, fmt.Errorf("scan %s: %w", pattern, err)
+		}
+	}
+	return res, nil
+}
+
+// GetExpiry reports expiry of all user data
+func (r *RedisDataManager) GetExpiry(ctx context.Context, userID string) ([]*domain.Expiry, error) {
+	keys := []dataKey{r.keyConfig(userID), r.keyTexts(userID), r.keyDictionary(userID)}
+	ids := []string{"", "", ""}
+	for _, prefix := range []dataKey{r.keyAudio(userID, ""), r.keyTranscript(userID, "")} {
+		err := r.scan(ctx, escapeGlob(prefix.redis)+"*", func(key string) {
+			id, ok := strings.CutPrefix(key, prefix.redis)
+			if !ok || len(id) != ulidLen || strings.ContainsAny(id, "-:") {
+				return
+			}
+			keys = append(keys, dataKey{Binding: secure.Binding{Type: prefix.Type, User: userID}, redis: key})
+			ids = append(ids, id)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("scan %s: %w", prefix.Type, err)
+		}
+	}
+	cmds := make([]*redis.DurationCmd, len(keys))
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			cmds[i] = pipe.PTTL(ctx, key.redis)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("get ttl: %w", err)
+	}
+	now := time.Now()
+	var res []*domain.Expiry
+	for i, cmd := range cmds {
+		ttl := cmd.Val()
+		if ttl == -2 {
+			continue // missing
+		}
+		item := &domain.Expiry{Type: keys[i].Type, ID: ids[i], Sliding: r.retention.of(keys[i].Type).Sliding}
+		if ttl > 0 {
+			at := now.Add(ttl)
+			item.ExpiresAt = &at
+		}
+		res = append(res, item)
+	}
+	return res, nil
+}
+
+const ulidLen = 26
+
+func escapeGlob(s string) string {
+	res := strings.Builder{}
+	for _, c := range s {
+		if strings.ContainsRune(`*?[]\`, c) {
+			res.WriteRune('\\')
+		}
+		res.WriteRune(c)
+	}
+	return res.String()
+}
+
+// Client returns the redis client to share the connection
+func (r *RedisDataManager) Client() redis.UniversalClient {
+	return r.client
+}
+
 func (r *RedisDataManager) Close() error {
 	return r.client.Close()
 }
@@ -0,0 +1,192 @@
+package db
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"io"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/airenas/rt-transcriber-wrapper/internal/secure"
+)
+
+func Test_keyOf(t *testing.T) {
+	r := &RedisDataManager{}
+	tests := []struct {
+		name   string
+		key    string
+		want   dataKey
+		wantOk bool
+	}{
+		{name: "audio", key: "audio:{u-1}:01K6CZRXNCNZZ1HQHMVGGJAD16",
+			want: r.keyAudio("u-1", "01K6CZRXNCNZZ1HQHMVGGJAD16"), wantOk: true},
+		{name: "config", key: "user:{u:1}", want: r.keyConfig("u:1"), wantOk: true},
+		{name: "texts", key: "texts:{u1}", want: r.keyTexts("u1"), wantOk: true},
+		{name: "dictionary", key: "dictionary:{u1}", want: r.keyDictionary("u1"), wantOk: true},
+		{name: "transcript", key: "transcript:{u:1}:01K6CZRXNCNZZ1HQHMVGGJAD16",
+			want: r.keyTranscript("u:1", "01K6CZRXNCNZZ1HQHMVGGJAD16"), wantOk: true},
+		{name: "no user", key: "texts:{}", wantOk: false},
+		{name: "legacy", key: "texts:u1", wantOk: false},
+		{name: "bad audio", key: "audio:{u1}:", wantOk: false},
+		{name: "unknown", key: "other:{u1}", wantOk: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, gotOk := r.keyOf(tt.key)
+			if gotOk != tt.wantOk {
+				t.Fatalf("keyOf() ok = %v, want %v", gotOk, tt.wantOk)
+			}
+			if gotOk && got != tt.want {
+				t.Errorf("keyOf() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_legacyKeyOf(t *testing.T) {
+	r := &RedisDataManager{}
+	tests := []struct {
+		name   string
+		key    string
+		want   dataKey
+		wantOk bool
+	}{
+		{name: "audio", key: "audio:audio-u-1-01K6CZRXNCNZZ1HQHMVGGJAD16",
+			want: r.keyAudio("u-1", "01K6CZRXNCNZZ1HQHMVGGJAD16"), wantOk: true},
+		{name: "config", key: "user:u:1", want: r.keyConfig("u:1"), wantOk: true},
+		{name: "texts", key: "texts:u1", want: r.keyTexts("u1"), wantOk: true},
+		{name: "transcript", key: "transcript:u:1:01K6CZRXNCNZZ1HQHMVGGJAD16",
+			want: r.keyTranscript("u:1", "01K6CZRXNCNZZ1HQHMVGGJAD16"), wantOk: true},
+		{name: "new layout", key: "texts:{u1}", wantOk: false},
+		{name: "no user", key: "texts:", wantOk: false},
+		{name: "bad audio", key: "audio:audio-01K6", wantOk: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, gotOk := r.legacyKeyOf(tt.key)
+			if gotOk != tt.wantOk {
+				t.Fatalf("legacyKeyOf() ok = %v, want %v", gotOk, tt.wantOk)
+			}
+			if gotOk && got != tt.want {
+				t.Errorf("legacyKeyOf() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_universalOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     RedisConfig
+		want    []string
+		wantErr bool
+	}{
+		{name: "url", cfg: RedisConfig{URL: "redis://localhost:6379/1"}, want: []string{"localhost:6379"}},
+		{name: "sentinel", cfg: RedisConfig{Addrs: []string{"s1:26379", "s2:26379"}, MasterName: "m"},
+			want: []string{"s1:26379", "s2:26379"}},
+		{name: "cluster", cfg: RedisConfig{Addrs: []string{"c1:6379"}, Cluster: true}, want: []string{"c1:6379"}},
+		{name: "cluster with master", cfg: RedisConfig{Addrs: []string{"c1:6379"}, Cluster: true, MasterName: "m"}, wantErr: true},
+		{name: "cluster with db", cfg: RedisConfig{Addrs: []string{"c1:6379"}, Cluster: true, DB: 1}, wantErr: true},
+		{name: "bad url", cfg: RedisConfig{URL: "http://x"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := universalOptions(tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("universalOptions() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !slices.Equal(got.Addrs, tt.want) {
+				t.Errorf("universalOptions() = %v, want %v", got.Addrs, tt.want)
+			}
+		})
+	}
+}
+
+func Test_escapeGlob(t *testing.T) {
+	if got, want := escapeGlob(`a*b?[c]\d`), `a\*b\?\[c\]\\d`; got != want {
+		t.Errorf("escapeGlob() = %v, want %v", got, want)
+	}
+}
+
+func TestRetentionPolicy_of(t *testing.T) {
+	p := RetentionPolicy{Audio: Retention{TTL: time.Hour}, Texts: Retention{TTL: 2 * time.Hour},
+		Transcripts: Retention{TTL: 3 * time.Hour}, Configs: Retention{TTL: 4 * time.Hour}, Dictionaries: Retention{TTL: 5 * time.Hour}}
+	tests := []struct {
+		dataType string
+		want     time.Duration
+	}{
+		{dataType: typeAudio, want: time.Hour},
+		{dataType: typeTexts, want: 2 * time.Hour},
+		{dataType: typeTranscript, want: 3 * time.Hour},
+		{dataType: typeConfig, want: 4 * time.Hour},
+		{dataType: typeDictionary, want: 5 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.dataType, func(t *testing.T) {
+			if got := p.of(tt.dataType).TTL; got != tt.want {
+				t.Errorf("of() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetentionPolicy_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		p       RetentionPolicy
+		wantErr bool
+	}{
+		{name: "ok", p: RetentionPolicy{Audio: Retention{TTL: time.Hour}, Texts: Retention{TTL: time.Hour, Sliding: true}}},
+		{name: "low", p: RetentionPolicy{Audio: Retention{TTL: time.Minute}}, wantErr: true},
+		{name: "low configs", p: RetentionPolicy{Configs: Retention{TTL: time.Minute}}, wantErr: true},
+		{name: "low dictionaries", p: RetentionPolicy{Dictionaries: Retention{TTL: time.Minute}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.p.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_openAudio(t *testing.T) {
+	key := []byte("11111111111111111111111111111111")
+	c, _ := secure.NewKeyring(map[string][]byte{"k1": key}, "k1")
+	b := secure.Binding{Type: typeAudio, User: "alice", Key: "audio:1"}
+	block, _ := aes.NewCipher(key)
+	aead, _ := cipher.NewGCM(block)
+	nonce := make([]byte, aead.NonceSize())
+	nonce[0] = 3 // a legacy nonce looking like the stream header
+	legacy := aead.Seal(nonce, nonce, []byte("wav"), nil)
+	stream, _ := c.EncryptStream([]byte("wav"), b)
+	bound, _ := c.EncryptFor([]byte("wav"), b)
+	tampered := slices.Clone(stream)
+	tampered[len(tampered)-1] ^= 1
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{name: "stream", data: stream},
+		{name: "bound", data: bound},
+		{name: "legacy stream like", data: legacy},
+		{name: "tampered stream", data: tampered, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := openAudio(c, bytes.NewReader(tt.data), int64(len(tt.data)), b)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("openAudio() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got, err := io.ReadAll(r); err != nil || string(got) != "wav" {
+				t.Errorf("openAudio() = %s, %v", got, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+// minTTL protects from too short, probably misconfigured TTLs
+const minTTL = 5 * time.Minute
+
+// Retention is an expiry policy of one data type
+type Retention struct {
+	// TTL of the data, 0 - the data never expires
+	TTL time.Duration
+	// Sliding refreshes TTL on every read
+	Sliding bool
+}
+
+// RetentionPolicy keeps retention per data type
+type RetentionPolicy struct {
+	Audio        Retention
+	Texts        Retention
+	Transcripts  Retention
+	Configs      Retention
+	Dictionaries Retention
+}
+
+// of returns the retention of the data type, every stored type must have its own case
+func (p *RetentionPolicy) of(dataType string) Retention {
+	switch dataType {
+	case typeAudio:
+		return p.Audio
+	case typeTexts:
+		return p.Texts
+	case typeTranscript:
+		return p.Transcripts
+	case typeConfig:
+		return p.Configs
+	case typeDictionary:
+		return p.Dictionaries
+	}
+	return Retention{}
+}
+
+func (p *RetentionPolicy) validate() error {
+	for _, t := range []string{typeAudio, typeTexts, typeTranscript, typeConfig, typeDictionary} {
+		if ttl := p.of(t).TTL; ttl != 0 && ttl <= minTTL {
+			return fmt.Errorf("%s TTL is set to a low value of %s, it should be at least %s", t, ttl, minTTL)
+		}
+	}
+	return nil
+}
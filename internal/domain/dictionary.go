@@ -0,0 +1,115 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// MaxDictionaryRules limits the rules of one user
+const MaxDictionaryRules = 1000
+
+var (
+	// ErrRuleNotFound is returned when a rule with the requested ID does not exist
+	ErrRuleNotFound = errors.New("rule not found")
+	// ErrRuleExists is returned when adding a rule with an already used ID
+	ErrRuleExists = errors.New("rule already exists")
+	// ErrWrongRule is returned for an empty phrase, a wrong regex or too many rules
+	ErrWrongRule = errors.New("wrong rule")
+)
+
+// DictionaryRule replaces a phrase in transcripts
+type DictionaryRule struct {
+	ID string `json:"id"`
+	// From is the phrase matched case insensitively at word boundaries
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Regex treats From as a regular expression, To may refer to its groups as $1
+	Regex bool `json:"regex,omitempty"`
+	// PreserveCase applies the case of the matched text to To: all upper or the first letter upper
+	PreserveCase bool `json:"preserveCase,omitempty"`
+}
+
+// Validate checks the phrase and the regex
+func (r *DictionaryRule) Validate() error {
+	if strings.TrimSpace(r.From) == "" {
+		return fmt.Errorf("no from: %w", ErrWrongRule)
+	}
+	if r.Regex {
+		if _, err := regexp.Compile(r.From); err != nil {
+			return fmt.Errorf("%s: %w", err.Error(), ErrWrongRule)
+		}
+	}
+	return nil
+}
+
+// Dictionary keeps the replacement rules of a user, they are applied in order
+type Dictionary struct {
+	Rules []DictionaryRule `json:"rules"`
+}
+
+// Add appends a new rule to the end
+func (d *Dictionary) Add(rule DictionaryRule) error {
+	if err := rule.Validate(); err != nil {
+		return err
+	}
+	if d.index(rule.ID) >= 0 {
+		return fmt.Errorf("%s: %w", rule.ID, ErrRuleExists)
+	}
+	if len(d.Rules) >= MaxDictionaryRules {
+		return fmt.Errorf("more than %d rules: %w", MaxDictionaryRules, ErrWrongRule)
+	}
+	d.Rules = append(d.Rules, rule)
+	return nil
+}
+
+// Update replaces an existing rule
+func (d *Dictionary) Update(rule DictionaryRule) error {
+	if err := rule.Validate(); err != nil {
+		return err
+	}
+	i := d.index(rule.ID)
+	if i < 0 {
+		return fmt.Errorf("%s: %w", rule.ID, ErrRuleNotFound)
+	}
+	d.Rules[i] = rule
+	return nil
+}
+
+// Delete removes a rule by ID
+func (d *Dictionary) Delete(id string) error {
+	i := d.index(id)
+	if i < 0 {
+		return fmt.Errorf("%s: %w", id, ErrRuleNotFound)
+	}
+	d.Rules = append(d.Rules[:i], d.Rules[i+1:]...)
+	return nil
+}
+
+// Validate checks all rules, their count and unique IDs
+func (d *Dictionary) Validate() error {
+	if len(d.Rules) > MaxDictionaryRules {
+		return fmt.Errorf("more than %d rules: %w", MaxDictionaryRules, ErrWrongRule)
+	}
+	ids := make(map[string]bool, len(d.Rules))
+	for _, r := range d.Rules {
+		if err := r.Validate(); err != nil {
+			return err
+		}
+		if ids[r.ID] {
+			return fmt.Errorf("%s: %w", r.ID, ErrRuleExists)
+		}
+		ids[r.ID] = true
+	}
+	return nil
+}
+
+func (d *Dictionary) index(id string) int {
+	for i, r := range d.Rules {
+		if r.ID == id {
+			return i
+		}
+	}
+	return -1
+}
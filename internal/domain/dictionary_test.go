@@ -0,0 +1,55 @@
+package domain
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDictionary_Add(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    DictionaryRule
+		wantErr error
+	}{
+		{name: "ok", rule: DictionaryRule{ID: "2", From: "a", To: "b"}},
+		{name: "regex", rule: DictionaryRule{ID: "2", From: `(\d+) mg`, To: "$1mg", Regex: true}},
+		{name: "exists", rule: DictionaryRule{ID: "1", From: "a"}, wantErr: ErrRuleExists},
+		{name: "no from", rule: DictionaryRule{ID: "2", From: " "}, wantErr: ErrWrongRule},
+		{name: "wrong regex", rule: DictionaryRule{ID: "2", From: "(", Regex: true}, wantErr: ErrWrongRule},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &Dictionary{Rules: []DictionaryRule{{ID: "1", From: "x"}}}
+			err := d.Add(tt.rule)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Add() err = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && len(d.Rules) != 2 {
+				t.Errorf("Add() len = %d, want 2", len(d.Rules))
+			}
+		})
+	}
+}
+
+func TestDictionary_UpdateDelete(t *testing.T) {
+	d := &Dictionary{Rules: []DictionaryRule{{ID: "1", From: "x"}, {ID: "2", From: "y"}}}
+	if err := d.Update(DictionaryRule{ID: "2", From: "z"}); err != nil || d.Rules[1].From != "z" {
+		t.Errorf("Update() = %v, %v", d.Rules[1], err)
+	}
+	if err := d.Update(DictionaryRule{ID: "3", From: "z"}); !errors.Is(err, ErrRuleNotFound) {
+		t.Errorf("Update() err = %v, want %v", err, ErrRuleNotFound)
+	}
+	if err := d.Delete("1"); err != nil || len(d.Rules) != 1 || d.Rules[0].ID != "2" {
+		t.Errorf("Delete() = %v, %v", d.Rules, err)
+	}
+	if err := d.Delete("1"); !errors.Is(err, ErrRuleNotFound) {
+		t.Errorf("Delete() err = %v, want %v", err, ErrRuleNotFound)
+	}
+}
+
+func TestDictionary_Validate(t *testing.T) {
+	d := &Dictionary{Rules: []DictionaryRule{{ID: "1", From: "x"}, {ID: "1", From: "y"}}}
+	if err := d.Validate(); !errors.Is(err, ErrRuleExists) {
+		t.Errorf("Validate() err = %v, want %v", err, ErrRuleExists)
+	}
+}
@@ -0,0 +1,13 @@
+package domain
+
+import "time"
+
+// Expiry tells when a stored item expires
+type Expiry struct {
+	Type string
+	ID   string
+	// ExpiresAt is nil if the item never expires
+	ExpiresAt *time.Time
+	// Sliding is true if reading the item extends its life
+	Sliding bool
+}
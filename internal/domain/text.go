@@ -1,5 +1,19 @@
 package domain
 
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrPartNotFound is returned when a part with the requested ID does not exist
+	ErrPartNotFound = errors.New("part not found")
+	// ErrPartExists is returned when appending a part with an already used ID
+	ErrPartExists = errors.New("part already exists")
+	// ErrWrongOrder is returned when reorder IDs do not match the existing parts
+	ErrWrongOrder = errors.New("wrong order")
+)
+
 type Part struct {
 	ID   string `json:"id"`
 	Text string `json:"text"`
@@ -8,3 +22,72 @@ type Part struct {
 type Texts struct {
 	Parts []Part `json:"parts"`
 }
+
+// Append adds a new part to the end
+func (t *Texts) Append(part Part) error {
+	if t.index(part.ID) >= 0 {
+		return fmt.Errorf("%s: %w", part.ID, ErrPartExists)
+	}
+	t.Parts = append(t.Parts, part)
+	return nil
+}
+
+// Update replaces the text of an existing part
+func (t *Texts) Update(part Part) error {
+	i := t.index(part.ID)
+	if i < 0 {
+		return fmt.Errorf("%s: %w", part.ID, ErrPartNotFound)
+	}
+	t.Parts[i].Text = part.Text
+	return nil
+}
+
+// Delete removes a part by ID
+func (t *Texts) Delete(id string) error {
+	i := t.index(id)
+	if i < 0 {
+		return fmt.Errorf("%s: %w", id, ErrPartNotFound)
+	}
+	t.Parts = append(t.Parts[:i], t.Parts[i+1:]...)
+	return nil
+}
+
+// Reorder rearranges parts by the provided IDs, the IDs must contain every part exactly once
+func (t *Texts) Reorder(ids []string) error {
+	if len(ids) != len(t.Parts) {
+		return fmt.Errorf("expected %d ids, got %d: %w", len(t.Parts), len(ids), ErrWrongOrder)
+	}
+	byID := make(map[string]Part, len(t.Parts))
+	for _, p := range t.Parts {
+		byID[p.ID] = p
+	}
+	res := make([]Part, 0, len(ids))
+	for _, id := range ids {
+		p, ok := byID[id]
+		if !ok {
+			return fmt.Errorf("unknown or duplicate id %s: %w", id, ErrWrongOrder)
+		}
+		delete(byID, id)
+		res = append(res, p)
+	}
+	t.Parts = res
+	return nil
+}
+
+func (t *Texts) index(id string) int {
+	for i, p := range t.Parts {
+		if p.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Size returns the size of all part texts in bytes
+func (t *Texts) Size() int64 {
+	var res int64
+	for _, p := range t.Parts {
+		res += int64(len(p.Text))
+	}
+	return res
+}
@@ -0,0 +1,93 @@
+package domain
+
+import (
+	"errors"
+	"testing"
+)
+
+func testTexts() *Texts {
+	return &Texts{Parts: []Part{{ID: "1", Text: "a"}, {ID: "2", Text: "b"}, {ID: "3", Text: "c"}}}
+}
+
+func ids(t *Texts) string {
+	res := ""
+	for _, p := range t.Parts {
+		res += p.ID
+	}
+	return res
+}
+
+func TestTexts_Append(t *testing.T) {
+	texts := testTexts()
+	if err := texts.Append(Part{ID: "4", Text: "d"}); err != nil {
+		t.Fatalf("Append() failed: %v", err)
+	}
+	if got := ids(texts); got != "1234" {
+		t.Errorf("Append() = %v, want %v", got, "1234")
+	}
+	if err := texts.Append(Part{ID: "2"}); !errors.Is(err, ErrPartExists) {
+		t.Errorf("Append() err = %v, want %v", err, ErrPartExists)
+	}
+}
+
+func TestTexts_Update(t *testing.T) {
+	texts := testTexts()
+	if err := texts.Update(Part{ID: "2", Text: "x"}); err != nil {
+		t.Fatalf("Update() failed: %v", err)
+	}
+	if texts.Parts[1].Text != "x" {
+		t.Errorf("Update() = %v, want %v", texts.Parts[1].Text, "x")
+	}
+	if err := texts.Update(Part{ID: "5"}); !errors.Is(err, ErrPartNotFound) {
+		t.Errorf("Update() err = %v, want %v", err, ErrPartNotFound)
+	}
+}
+
+func TestTexts_Delete(t *testing.T) {
+	texts := testTexts()
+	if err := texts.Delete("2"); err != nil {
+		t.Fatalf("Delete() failed: %v", err)
+	}
+	if got := ids(texts); got != "13" {
+		t.Errorf("Delete() = %v, want %v", got, "13")
+	}
+	if err := texts.Delete("2"); !errors.Is(err, ErrPartNotFound) {
+		t.Errorf("Delete() err = %v, want %v", err, ErrPartNotFound)
+	}
+}
+
+func TestTexts_Reorder(t *testing.T) {
+	tests := []struct {
+		name    string
+		ids     []string
+		want    string
+		wantErr bool
+	}{
+		{name: "ok", ids: []string{"3", "1", "2"}, want: "312"},
+		{name: "same", ids: []string{"1", "2", "3"}, want: "123"},
+		{name: "missing", ids: []string{"1", "2"}, wantErr: true},
+		{name: "duplicate", ids: []string{"1", "1", "2"}, wantErr: true},
+		{name: "unknown", ids: []string{"1", "2", "4"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			texts := testTexts()
+			gotErr := texts.Reorder(tt.ids)
+			if gotErr != nil {
+				if !tt.wantErr {
+					t.Errorf("Reorder() failed: %v", gotErr)
+				}
+				if got := ids(texts); got != "123" {
+					t.Errorf("Reorder() changed data on error = %v", got)
+				}
+				return
+			}
+			if tt.wantErr {
+				t.Fatal("Reorder() succeeded unexpectedly")
+			}
+			if got := ids(texts); got != tt.want {
+				t.Errorf("Reorder() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
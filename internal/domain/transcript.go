@@ -0,0 +1,74 @@
+package domain
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned when the requested record does not exist
+var ErrNotFound = errors.New("not found")
+
+type Word struct {
+	Start      float64 `json:"start"`
+	Length     float64 `json:"length"`
+	Word       string  `json:"word"`
+	Confidence float64 `json:"confidence"`
+}
+
+type TranscriptSegment struct {
+	Segment int     `json:"segment"`
+	Start   float64 `json:"start"`
+	Length  float64 `json:"length"`
+	Text    string  `json:"text"`
+	Words   []Word  `json:"words,omitempty"`
+}
+
+// Transcript keeps final results of one transcription session,
+// ID matches the ID of the saved audio
+type Transcript struct {
+	ID       string              `json:"id"`
+	UserID   string              `json:"userId"`
+	Created  time.Time           `json:"created"`
+	Updated  time.Time           `json:"updated"`
+	Segments []TranscriptSegment `json:"segments"`
+}
+
+// SetSegment adds a segment or replaces the one with the same number
+func (t *Transcript) SetSegment(s TranscriptSegment) {
+	t.Updated = time.Now()
+	for i := range t.Segments {
+		if t.Segments[i].Segment == s.Segment {
+			t.Segments[i] = s
+			return
+		}
+	}
+	t.Segments = append(t.Segments, s)
+}
+
+// UpdateText changes the text of an existing segment, returns false if nothing changed
+func (t *Transcript) UpdateText(segment int, text string) bool {
+	for i := range t.Segments {
+		if t.Segments[i].Segment == segment && t.Segments[i].Text != text {
+			t.Segments[i].Text = text
+			t.Updated = time.Now()
+			return true
+		}
+	}
+	return false
+}
+
+// Text returns the full transcript text
+func (t *Transcript) Text() string {
+	res := strings.Builder{}
+	for _, s := range t.Segments {
+		if s.Text == "" {
+			continue
+		}
+		if res.Len() > 0 {
+			res.WriteString(" ")
+		}
+		res.WriteString(s.Text)
+	}
+	return res.String()
+}
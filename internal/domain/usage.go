@@ -0,0 +1,28 @@
+package domain
+
+import "errors"
+
+// ErrQuotaExceeded is returned when saving data would exceed the user quota
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Quota is a storage amount per user, in limits 0 means no limit
+type Quota struct {
+	AudioBytes int64
+	Recordings int64
+	TextBytes  int64
+}
+
+// Usage reports the consumed storage and the limits of a user
+type Usage struct {
+	Used  Quota
+	Limit Quota
+}
+
+// Exceeds checks if the used amount is over any set limit
+func (q Quota) Exceeds(limit Quota) bool {
+	return over(q.AudioBytes, limit.AudioBytes) || over(q.Recordings, limit.Recordings) || over(q.TextBytes, limit.TextBytes)
+}
+
+func over(v, limit int64) bool {
+	return limit > 0 && v > limit
+}
@@ -0,0 +1,25 @@
+package domain
+
+import "testing"
+
+func TestQuota_Exceeds(t *testing.T) {
+	limit := Quota{AudioBytes: 100, Recordings: 2}
+	tests := []struct {
+		name string
+		q    Quota
+		want bool
+	}{
+		{name: "empty", q: Quota{}, want: false},
+		{name: "at limit", q: Quota{AudioBytes: 100, Recordings: 2}, want: false},
+		{name: "audio", q: Quota{AudioBytes: 101}, want: true},
+		{name: "recordings", q: Quota{Recordings: 3}, want: true},
+		{name: "no text limit", q: Quota{TextBytes: 1 << 30}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.q.Exceeds(limit); got != tt.want {
+				t.Errorf("Exceeds() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
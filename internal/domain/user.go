@@ -3,5 +3,8 @@ package domain
 type User struct {
 	ID       string `json:"id"`
 	SkipTour bool   `json:"showTour"`
+	// Profile selects the middleware pipeline, empty - the default one
+	Profile string `json:"profile,omitempty"`
+	// Masking enables masking of sensitive terms, nil - the stage default
+	Masking *bool `json:"masking,omitempty"`
 }
-
@@ -0,0 +1,151 @@
+package export
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/airenas/rt-transcriber-wrapper/internal/domain"
+)
+
+const (
+	FormatSRT  = "srt"
+	FormatVTT  = "vtt"
+	FormatTxt  = "txt"
+	FormatJSON = "json"
+)
+
+// Options limits the size of a single subtitle cue
+type Options struct {
+	MaxChars    int
+	MaxDuration time.Duration
+}
+
+// DefaultOptions returns usual subtitle limits
+func DefaultOptions() Options {
+	return Options{MaxChars: 84, MaxDuration: 7 * time.Second}
+}
+
+// Cue is one subtitle entry
+type Cue struct {
+	Start time.Duration
+	End   time.Duration
+	Text  string
+}
+
+type token struct {
+	text       string
+	start, end float64
+}
+
+// ContentType returns the http content type of the format
+func ContentType(format string) string {
+	switch format {
+	case FormatSRT:
+		return "application/x-subrip; charset=utf-8"
+	case FormatVTT:
+		return "text/vtt; charset=utf-8"
+	case FormatJSON:
+		return "application/json; charset=utf-8"
+	}
+	return "text/plain; charset=utf-8"
+}
+
+// Write writes the transcript in srt, vtt or txt format
+func Write(w io.Writer, format string, transcript *domain.Transcript, opt Options) error {
+	switch format {
+	case FormatSRT:
+		return writeCues(w, "", ",", Cues(transcript, opt), true)
+	case FormatVTT:
+		return writeCues(w, "WEBVTT\n\n", ".", Cues(transcript, opt), false)
+	case FormatTxt:
+		_, err := io.WriteString(w, transcript.Text()+"\n")
+		return err
+	}
+	return fmt.Errorf("unsupported format '%s'", format)
+}
+
+// Cues splits transcript segments into subtitle cues
+func Cues(transcript *domain.Transcript, opt Options) []Cue {
+	var res []Cue
+	for _, s := range transcript.Segments {
+		var cue *Cue
+		var b strings.Builder
+		flush := func() {
+			if cue != nil {
+				cue.Text = b.String()
+				res = append(res, *cue)
+			}
+			cue = nil
+			b.Reset()
+		}
+		for _, t := range segmentTokens(s) {
+			start, end := toDuration(t.start), toDuration(t.end)
+			if cue != nil && (opt.MaxChars > 0 && b.Len()+1+len(t.text) > opt.MaxChars ||
+				opt.MaxDuration > 0 && end-cue.Start > opt.MaxDuration) {
+				flush()
+			}
+			if cue == nil {
+				cue = &Cue{Start: start}
+			} else {
+				b.WriteString(" ")
+			}
+			b.WriteString(t.text)
+			cue.End = end
+		}
+		flush()
+	}
+	return res
+}
+
+// segmentTokens assigns absolute times to the punctuated words of a segment.
+// Word timings are used when they match the words one to one,
+// otherwise the segment time is split proportionally to word lengths
+func segmentTokens(s domain.TranscriptSegment) []token {
+	words := strings.Fields(s.Text)
+	if len(words) == 0 {
+		return nil
+	}
+	res := make([]token, 0, len(words))
+	if len(words) == len(s.Words) {
+		for i, w := range words {
+			wa := s.Words[i]
+			res = append(res, token{text: w, start: s.Start + wa.Start, end: s.Start + wa.Start + wa.Length})
+		}
+		return res
+	}
+	total := 0
+	for _, w := range words {
+		total += len([]rune(w))
+	}
+	at := s.Start
+	for _, w := range words {
+		l := s.Length * float64(len([]rune(w))) / float64(total)
+		res = append(res, token{text: w, start: at, end: at + l})
+		at += l
+	}
+	return res
+}
+
+func writeCues(w io.Writer, header, msSep string, cues []Cue, numbered bool) error {
+	var b strings.Builder
+	b.WriteString(header)
+	for i, c := range cues {
+		if numbered {
+			fmt.Fprintf(&b, "%d\n", i+1)
+		}
+		fmt.Fprintf(&b, "%s --> %s\n%s\n\n", formatTime(c.Start, msSep), formatTime(c.End, msSep), c.Text)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func formatTime(d time.Duration, msSep string) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d", ms/3600000, ms/60000%60, ms/1000%60, msSep, ms%1000)
+}
+
+func toDuration(sec float64) time.Duration {
+	return time.Duration(sec * float64(time.Second)).Round(time.Millisecond)
+}
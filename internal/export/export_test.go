@@ -0,0 +1,65 @@
+package export
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/airenas/rt-transcriber-wrapper/internal/domain"
+)
+
+func testTranscript() *domain.Transcript {
+	return &domain.Transcript{Segments: []domain.TranscriptSegment{
+		{Segment: 0, Start: 1, Length: 2, Text: "Labas rytas.",
+			Words: []domain.Word{{Start: 0, Length: 0.5, Word: "labas"}, {Start: 0.5, Length: 1, Word: "rytas"}}},
+		{Segment: 1, Start: 3600, Length: 2, Text: "23 obuoliai",
+			Words: []domain.Word{{Start: 0, Length: 0.5, Word: "dvidešimt"}, {Start: 0.5, Length: 0.5, Word: "trys"},
+				{Start: 1, Length: 1, Word: "obuoliai"}}},
+	}}
+}
+
+func TestWrite(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		want    string
+		wantErr bool
+	}{
+		{name: "srt", format: FormatSRT,
+			want: "1\n00:00:01,000 --> 00:00:02,500\nLabas rytas.\n\n2\n01:00:00,000 --> 01:00:02,000\n23 obuoliai\n\n"},
+		{name: "vtt", format: FormatVTT,
+			want: "WEBVTT\n\n00:00:01.000 --> 00:00:02.500\nLabas rytas.\n\n01:00:00.000 --> 01:00:02.000\n23 obuoliai\n\n"},
+		{name: "txt", format: FormatTxt, want: "Labas rytas. 23 obuoliai\n"},
+		{name: "unknown", format: "doc", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &strings.Builder{}
+			gotErr := Write(b, tt.format, testTranscript(), DefaultOptions())
+			if gotErr != nil {
+				if !tt.wantErr {
+					t.Errorf("Write() failed: %v", gotErr)
+				}
+				return
+			}
+			if tt.wantErr {
+				t.Fatal("Write() succeeded unexpectedly")
+			}
+			if b.String() != tt.want {
+				t.Errorf("Write() = %q, want %q", b.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestCues_Limits(t *testing.T) {
+	tr := &domain.Transcript{Segments: []domain.TranscriptSegment{{Start: 0, Length: 4, Text: "aaa bbb ccc ddd"}}}
+	got := Cues(tr, Options{MaxChars: 7})
+	if len(got) != 2 || got[0].Text != "aaa bbb" || got[1].Text != "ccc ddd" {
+		t.Errorf("Cues() = %v", got)
+	}
+	got = Cues(tr, Options{MaxDuration: time.Second})
+	if len(got) != 4 || got[3].Start != 3*time.Second || got[3].End != 4*time.Second {
+		t.Errorf("Cues() = %v", got)
+	}
+}
@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/airenas/rt-transcriber-wrapper/internal/api"
+)
+
+// TokenSpan is the range [From, To) of input tokens an output token is made from
+type TokenSpan struct {
+	From, To int
+}
+
+// TokenMap maps every output token of a stage to its input tokens
+type TokenMap []TokenSpan
+
+// tokenMapper is implemented by stages knowing how they rewrite the tokens.
+// The output of other stages is aligned to the input by matching words, see alignTokens
+type tokenMapper interface {
+	mapTokens(in, out []string) TokenMap
+}
+
+// alignment tracks how the current transcript tokens map to the original word alignment entries
+type alignment struct {
+	words []api.WordAlignment
+	spans TokenMap
+}
+
+func newAlignment(hyp *api.Hypothesis) *alignment {
+	in := make([]string, 0, len(hyp.WordAlignment))
+	for _, wa := range hyp.WordAlignment {
+		in = append(in, wa.Word)
+	}
+	return &alignment{words: hyp.WordAlignment, spans: alignTokens(in, strings.Fields(hyp.Transcript))}
+}
+
+// apply composes the mapping of one stage rewriting in to out
+func (a *alignment) apply(h Handler, in, out []string) {
+	var m TokenMap
+	if mapper, ok := h.(tokenMapper); ok {
+		m = mapper.mapTokens(in, out)
+	}
+	if !m.valid(len(in), len(out)) {
+		m = alignTokens(in, out)
+	}
+	res := make(TokenMap, len(m))
+	for i, s := range m {
+		res[i] = TokenSpan{From: -1}
+		for j := s.From; j < s.To; j++ {
+			res[i] = res[i].union(a.spans[j])
+		}
+		if res[i].From < 0 {
+			res[i] = TokenSpan{}
+		}
+	}
+	a.spans = res
+}
+
+// result makes word alignment entries for the tokens with merged timings and mean confidences
+func (a *alignment) result(tokens []string) []api.WordAlignment {
+	res := make([]api.WordAlignment, 0, len(tokens))
+	for i, t := range tokens {
+		wa := api.WordAlignment{Word: t}
+		if s := a.spans[i]; s.To > s.From {
+			first, last := a.words[s.From], a.words[s.To-1]
+			wa.Start, wa.Length = first.Start, last.Start+last.Length-first.Start
+			for _, w := range a.words[s.From:s.To] {
+				wa.Confidence += w.Confidence
+			}
+			wa.Confidence /= float64(s.To - s.From)
+		}
+		res = append(res, wa)
+	}
+	return res
+}
+
+func (s TokenSpan) union(o TokenSpan) TokenSpan {
+	if o.To <= o.From {
+		return s
+	}
+	if s.From < 0 {
+		return o
+	}
+	return TokenSpan{From: min(s.From, o.From), To: max(s.To, o.To)}
+}
+
+func (m TokenMap) valid(in, out int) bool {
+	if m == nil || len(m) != out {
+		return false
+	}
+	for _, s := range m {
+		if s.From < 0 || s.To > in || s.From > s.To {
+			return false
+		}
+	}
+	return true
+}
+
+// identityMap maps tokens one to one
+func identityMap(n int) TokenMap {
+	res := make(TokenMap, n)
+	for i := range res {
+		res[i] = TokenSpan{From: i, To: i + 1}
+	}
+	return res
+}
+
+// alignTokens maps out to in by the longest common subsequence of normalized words.
+// Unmatched output tokens between two matches get the whole unmatched input range,
+// so "dvidešimt trys" -> "23" maps 23 to both words. Inserted tokens get the previous input token
+func alignTokens(in, out []string) TokenMap {
+	a, b := normalizeTokens(in), normalizeTokens(out)
+	// l[i][j] is the LCS length of a[i:] and b[j:]
+	l := make([][]int, len(a)+1)
+	for i := range l {
+		l[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				l[i][j] = l[i+1][j+1] + 1
+			} else {
+				l[i][j] = max(l[i+1][j], l[i][j+1])
+			}
+		}
+	}
+	res := make(TokenMap, len(b))
+	gap := func(ia, ib, oa, ob int) {
+		s := TokenSpan{From: ia, To: ib}
+		if ia == ib {
+			switch {
+			case ia > 0:
+				s = TokenSpan{From: ia - 1, To: ia}
+			case ia < len(a):
+				s = TokenSpan{From: ia, To: ia + 1}
+			}
+		}
+		for k := oa; k < ob; k++ {
+			res[k] = s
+		}
+	}
+	i, j, gi, gj := 0, 0, 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			gap(gi, i, gj, j)
+			res[j] = TokenSpan{From: i, To: i + 1}
+			i, j = i+1, j+1
+			gi, gj = i, j
+		case l[i+1][j] >= l[i][j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+	gap(gi, len(a), gj, len(b))
+	return res
+}
+
+func normalizeTokens(tokens []string) []string {
+	res := make([]string, len(tokens))
+	for i, t := range tokens {
+		res[i] = strings.ToLower(strings.TrimFunc(t, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }))
+	}
+	return res
+}
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/airenas/rt-transcriber-wrapper/internal/api"
+)
+
+func Test_alignTokens(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		out  string
+		want TokenMap
+	}{
+		{name: "same", in: "a b", out: "a b", want: TokenMap{{0, 1}, {1, 2}}},
+		{name: "punctuated", in: "a b", out: "A, b.", want: TokenMap{{0, 1}, {1, 2}}},
+		{name: "joined", in: "turiu dvidešimt trys obuolius", out: "turiu 23 obuolius", want: TokenMap{{0, 1}, {1, 3}, {3, 4}}},
+		{name: "split", in: "a 23 b", out: "a dvidešimt trys b", want: TokenMap{{0, 1}, {1, 2}, {1, 2}, {2, 3}}},
+		{name: "inserted", in: "a b", out: "a - b", want: TokenMap{{0, 1}, {0, 1}, {1, 2}}},
+		{name: "inserted first", in: "a b", out: "- a b", want: TokenMap{{0, 1}, {0, 1}, {1, 2}}},
+		{name: "dropped", in: "a eee b", out: "a b", want: TokenMap{{0, 1}, {2, 3}}},
+		{name: "empty in", in: "", out: "a", want: TokenMap{{0, 0}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := alignTokens(strings.Fields(tt.in), strings.Fields(tt.out)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("alignTokens() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+type replaceStage struct {
+	from, to string
+}
+
+func (s *replaceStage) Process(_ context.Context, _ *SessionState, data *api.FullResult) (*api.FullResult, error) {
+	data.Result.Hypotheses[0].Transcript = strings.ReplaceAll(data.Result.Hypotheses[0].Transcript, s.from, s.to)
+	return data, nil
+}
+
+func TestListHandler_Process_wordAlignment(t *testing.T) {
+	cleaner, _ := NewCleaner()
+	h, _ := NewListHandler()
+	h.AddStage("cleaner", cleaner, true)
+	h.AddStage("joiner", &replaceStage{from: "dvidešimt trys", to: "23"}, true)
+	h.AddStage("punctuator", &replaceStage{from: "obuolius", to: "obuolius."}, true)
+	data := &api.FullResult{Result: api.Result{Final: true, Hypotheses: []api.Hypothesis{{
+		Transcript: "turiu dvidešimt trys obuolius_ir",
+		WordAlignment: []api.WordAlignment{
+			{Start: 0, Length: 1, Word: "turiu", Confidence: 1},
+			{Start: 1, Length: 1, Word: "dvidešimt", Confidence: 0.8},
+			{Start: 2.5, Length: 0.5, Word: "trys", Confidence: 0.6},
+			{Start: 3, Length: 1, Word: "obuolius_ir", Confidence: 1},
+		}}}}}
+	got, err := h.Process(context.Background(), NewSessionState(), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []api.WordAlignment{
+		{Start: 0, Length: 1, Word: "turiu", Confidence: 1},
+		{Start: 1, Length: 2, Word: "23", Confidence: 0.7},
+		{Start: 3, Length: 1, Word: "obuolius.", Confidence: 1},
+		{Start: 3, Length: 1, Word: "ir", Confidence: 1},
+	}
+	if !reflect.DeepEqual(got.Result.Hypotheses[0].WordAlignment, want) {
+		t.Errorf("Process() = %v, want %v", got.Result.Hypotheses[0].WordAlignment, want)
+	}
+}
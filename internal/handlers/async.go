@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/airenas/go-app/pkg/goapp"
+	"github.com/airenas/rt-transcriber-wrapper/internal/api"
+)
+
+// partialLimiter is implemented by pipelines limiting the rate of partial results
+type partialLimiter interface {
+	PartialInterval() time.Duration
+	PartialStages() int
+}
+
+// splitter is implemented by pipelines having asynchronous stages
+type splitter interface {
+	// Split returns the stages to run at once and the stages to run in background, nil if there are none
+	Split() (Handler, Handler)
+}
+
+type asyncJob struct {
+	seq     uint64
+	state   *SessionState
+	handler Handler
+	data    *api.FullResult
+}
+
+// asyncRunner processes jobs of one session in order in a background goroutine.
+// Only the newest hypothesis of a segment is processed and delivered, finals are always processed,
+// so stages keeping segment memory see every final
+type asyncRunner struct {
+	deliver func(ctx context.Context, job *asyncJob, res *api.FullResult)
+
+	lock   sync.Mutex
+	jobs   []*asyncJob
+	seq    uint64
+	latest map[int]uint64
+	signal chan struct{}
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newAsyncRunner(ctx context.Context, deliver func(ctx context.Context, job *asyncJob, res *api.FullResult)) *asyncRunner {
+	ctx, cf := context.WithCancel(ctx)
+	res := &asyncRunner{deliver: deliver, latest: map[int]uint64{}, signal: make(chan struct{}, 1), cancel: cf,
+		done: make(chan struct{})}
+	go res.run(ctx)
+	return res
+}
+
+// add queues a copy of the data and marks it as the newest hypothesis of the segment
+func (r *asyncRunner) add(h Handler, state *SessionState, data *api.FullResult) {
+	r.lock.Lock()
+	r.seq++
+	r.latest[data.Segment] = r.seq
+	r.jobs = append(r.jobs, &asyncJob{seq: r.seq, state: state, handler: h, data: copyResult(data)})
+	r.lock.Unlock()
+	select {
+	case r.signal <- struct{}{}:
+	default:
+	}
+}
+
+// isLatest tells if no newer hypothesis of the job segment was queued
+func (r *asyncRunner) isLatest(job *asyncJob) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.latest[job.data.Segment] == job.seq
+}
+
+func (r *asyncRunner) next() *asyncJob {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for len(r.jobs) > 0 {
+		job := r.jobs[0]
+		r.jobs = r.jobs[1:]
+		if job.data.Result.Final || r.latest[job.data.Segment] == job.seq {
+			return job
+		}
+		goapp.Log.Debug().Int("segment", job.data.Segment).Msg("skip stale partial")
+		partialsSkipped.WithLabelValues("stale").Inc()
+		if l, ok := job.handler.(partialLimiter); ok {
+			callsSaved.Add(float64(l.PartialStages()))
+		}
+	}
+	return nil
+}
+
+func (r *asyncRunner) run(ctx context.Context) {
+	defer close(r.done)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.signal:
+		}
+		for job := r.next(); job != nil && ctx.Err() == nil; job = r.next() {
+			res, err := job.handler.Process(ctx, job.state, job.data)
+			if err != nil {
+				if !errors.Is(err, ErrStageFailed) {
+					goapp.Log.Error().Err(err).Int("segment", job.data.Segment).Msg("async process")
+				}
+				continue
+			}
+			r.deliver(ctx, job, res)
+		}
+	}
+}
+
+// close stops the runner and waits for the running job
+func (r *asyncRunner) close() {
+	r.cancel()
+	<-r.done
+}
+
+func copyResult(data *api.FullResult) *api.FullResult {
+	res := *data
+	res.Result.Hypotheses = make([]api.Hypothesis, len(data.Result.Hypotheses))
+	for i, h := range data.Result.Hypotheses {
+		h.WordAlignment = append([]api.WordAlignment(nil), h.WordAlignment...)
+		res.Result.Hypotheses[i] = h
+	}
+	res.OldUpdates = append([]*api.ShortResult(nil), data.OldUpdates...)
+	return &res
+}
@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/airenas/rt-transcriber-wrapper/internal/api"
+)
+
+type blockingStage struct {
+	release chan struct{}
+	lock    sync.Mutex
+	seen    []string
+}
+
+func (s *blockingStage) Process(_ context.Context, _ *SessionState, data *api.FullResult) (*api.FullResult, error) {
+	<-s.release
+	s.lock.Lock()
+	s.seen = append(s.seen, data.Result.Hypotheses[0].Transcript)
+	s.lock.Unlock()
+	return data, nil
+}
+
+func testResult(segment int, text string, final bool) *api.FullResult {
+	return &api.FullResult{Segment: segment, Result: api.Result{Final: final, Hypotheses: []api.Hypothesis{{Transcript: text}}}}
+}
+
+func TestAsyncRunner_Order(t *testing.T) {
+	stage := &blockingStage{release: make(chan struct{})}
+	var lock sync.Mutex
+	var delivered []string
+	var r *asyncRunner
+	r = newAsyncRunner(context.Background(), func(_ context.Context, job *asyncJob, res *api.FullResult) {
+		if r.isLatest(job) {
+			lock.Lock()
+			delivered = append(delivered, getText(res))
+			lock.Unlock()
+		}
+	})
+	defer r.close()
+
+	r.add(stage, NewSessionState(), testResult(1, "a", false))
+	time.Sleep(10 * time.Millisecond) // "a" is running
+	r.add(stage, NewSessionState(), testResult(1, "a b", false))
+	r.add(stage, NewSessionState(), testResult(1, "a b c", true))
+	r.add(stage, NewSessionState(), testResult(2, "d", false))
+	for i := 0; i < 3; i++ {
+		stage.release <- struct{}{}
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	stage.lock.Lock()
+	defer stage.lock.Unlock()
+	if got, want := len(stage.seen), 3; got != want {
+		t.Fatalf("processed %v, want %d jobs", stage.seen, want)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(delivered) != 2 || delivered[0] != "a b c" || delivered[1] != "d" {
+		t.Errorf("delivered = %v, want [a b c d]", delivered)
+	}
+}
+
+func TestCopyResult(t *testing.T) {
+	data := testResult(1, "a", false)
+	res := copyResult(data)
+	res.Result.Hypotheses[0].Transcript = "b"
+	if data.Result.Hypotheses[0].Transcript != "a" {
+		t.Errorf("copyResult() shares hypotheses")
+	}
+}
+
+func TestRecordSession_skipPartial(t *testing.T) {
+	h, _ := NewListHandler()
+	h.AddStage("a", &testStage{}, true)
+	h.SetPartialInterval(time.Hour)
+	rs := &RecordSession{}
+	defer rs.dropPending()
+	ctx := context.Background()
+	if rs.skipPartial(ctx, h, testResult(1, "a", false)) {
+		t.Errorf("skipPartial() = true for the first partial")
+	}
+	if !rs.skipPartial(ctx, h, testResult(1, "a b", false)) {
+		t.Errorf("skipPartial() = false within interval")
+	}
+	if rs.skipPartial(ctx, h, testResult(1, "a b", true)) {
+		t.Errorf("skipPartial() = true for final")
+	}
+	h.SetPartialInterval(0)
+	if rs.skipPartial(ctx, h, testResult(1, "a b", false)) {
+		t.Errorf("skipPartial() = true without interval")
+	}
+}
+
+func TestRecordSession_Process_pendingPartial(t *testing.T) {
+	tests := []struct {
+		name  string
+		final bool
+		want  []string
+	}{
+		{name: "flush newest", want: []string{"a", "a b c"}},
+		{name: "final", final: true, want: []string{"a", "a b c d"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _ := NewListHandler()
+			h.AddStage("a", &testStage{}, true)
+			h.SetPartialInterval(50 * time.Millisecond)
+			var lock sync.Mutex
+			var sent []string
+			rs := NewRecordSession(nil, nil, "u", "", func(msg *api.FullResult) error {
+				lock.Lock()
+				defer lock.Unlock()
+				sent = append(sent, getText(msg))
+				return nil
+			})
+			defer rs.Close()
+			rs.Start(false)
+			inputs := []*api.FullResult{testResult(0, "a", false), testResult(0, "a b", false), testResult(0, "a b c", false)}
+			if tt.final {
+				inputs = append(inputs, testResult(0, "a b c d", true))
+			}
+			for _, in := range inputs {
+				res, err := rs.Process(context.Background(), in, h)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, r := range res {
+					_ = rs.writeFunc(r)
+				}
+			}
+			time.Sleep(150 * time.Millisecond)
+			lock.Lock()
+			defer lock.Unlock()
+			if !reflect.DeepEqual(sent, tt.want) {
+				t.Errorf("sent = %v, want %v", sent, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/airenas/go-app/pkg/goapp"
+	"github.com/airenas/rt-transcriber-wrapper/internal/secure"
+	"github.com/redis/go-redis/v9"
+)
+
+// CacheConfig configures caching of stage results by input text
+type CacheConfig struct {
+	// Size of the in-process LRU cache, 0 - no caching
+	Size int           `mapstructure:"size"`
+	TTL  time.Duration `mapstructure:"ttl"`
+	// Shared also keeps results in Redis for other instances
+	Shared bool `mapstructure:"shared"`
+}
+
+// cacheable is implemented by stages that can cache their remote calls
+type cacheable interface {
+	setCache(c *stageCache)
+}
+
+type lruEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// lruCache is a bounded in-process cache with TTL
+type lruCache struct {
+	size int
+	ttl  time.Duration
+	now  func() time.Time
+
+	lock  sync.Mutex
+	order *list.List
+	items map[string]*list.Element
+}
+
+func newLRUCache(size int, ttl time.Duration) *lruCache {
+	return &lruCache{size: size, ttl: ttl, now: time.Now, order: list.New(), items: map[string]*list.Element{}}
+}
+
+func (c *lruCache) get(key string) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*lruEntry)
+	if c.now().After(e.expires) {
+		c.order.Remove(el)
+		delete(c.items, key)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return e.value, true
+}
+
+func (c *lruCache) set(key string, value []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*lruEntry)
+		e.value, e.expires = value, c.now().Add(c.ttl)
+		c.order.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.order.PushFront(&lruEntry{key: key, value: value, expires: c.now().Add(c.ttl)})
+	for c.order.Len() > c.size {
+		el := c.order.Back()
+		c.order.Remove(el)
+		delete(c.items, el.Value.(*lruEntry).key)
+	}
+}
+
+// stageCache keeps results of one stage locally and optionally in Redis.
+// Redis values are encrypted, as they contain user texts
+type stageCache struct {
+	name    string
+	local   *lruCache
+	client  redis.UniversalClient
+	crypter *secure.Crypter
+	ttl     time.Duration
+}
+
+func (c *stageCache) key(input string) string {
+	h := sha256.Sum256([]byte(c.name + "\x00" + input))
+	return hex.EncodeToString(h[:])
+}
+
+func (c *stageCache) binding(key string) secure.Binding {
+	return secure.Binding{Type: "cache", Key: "cache:" + c.name + ":" + key}
+}
+
+func (c *stageCache) get(ctx context.Context, key string) ([]byte, bool) {
+	if res, ok := c.local.get(key); ok {
+		cacheRequests.WithLabelValues(c.name, "hit").Inc()
+		return res, true
+	}
+	if c.client != nil {
+		b := c.binding(key)
+		data, err := c.client.Get(ctx, b.Key).Bytes()
+		if err == nil {
+			res, err := c.crypter.DecryptFor(data, b)
+			if err == nil {
+				cacheRequests.WithLabelValues(c.name, "shared_hit").Inc()
+				c.local.set(key, res)
+				return res, true
+			}
+			goapp.Log.Warn().Err(err).Str("stage", c.name).Msg("can't decrypt cached value")
+		} else if err != redis.Nil {
+			goapp.Log.Warn().Err(err).Str("stage", c.name).Msg("can't read cache")
+		}
+	}
+	cacheRequests.WithLabelValues(c.name, "miss").Inc()
+	return nil, false
+}
+
+func (c *stageCache) set(ctx context.Context, key string, value []byte) {
+	c.local.set(key, value)
+	if c.client == nil {
+		return
+	}
+	b := c.binding(key)
+	data, err := c.crypter.EncryptFor(value, b)
+	if err == nil {
+		err = c.client.Set(ctx, b.Key, data, c.ttl).Err()
+	}
+	if err != nil {
+		goapp.Log.Warn().Err(err).Str("stage", c.name).Msg("can't write cache")
+	}
+}
+
+// cached returns the cached result for the input or calls f and caches its result
+func cached[T any](ctx context.Context, c *stageCache, input string, f func() (T, error)) (T, error) {
+	if c == nil {
+		return f()
+	}
+	key := c.key(input)
+	var res T
+	if data, ok := c.get(ctx, key); ok {
+		if err := json.Unmarshal(data, &res); err == nil {
+			return res, nil
+		}
+	}
+	res, err := f()
+	if err != nil {
+		return res, err
+	}
+	if data, err := json.Marshal(res); err == nil {
+		c.set(ctx, key, data)
+	}
+	return res, nil
+}
+
+// cachedBatch returns the cached results for the inputs, the missing ones are made by one call of f
+func cachedBatch[T any](ctx context.Context, c *stageCache, inputs []string, f func(inputs []string) ([]T, error)) ([]T, error) {
+	if c == nil {
+		return f(inputs)
+	}
+	res := make([]T, len(inputs))
+	var missing []string
+	var at []int
+	for i, input := range inputs {
+		if data, ok := c.get(ctx, c.key(input)); ok && json.Unmarshal(data, &res[i]) == nil {
+			continue
+		}
+		missing = append(missing, input)
+		at = append(at, i)
+	}
+	if len(missing) == 0 {
+		return res, nil
+	}
+	made, err := f(missing)
+	if err != nil {
+		return nil, err
+	}
+	if len(made) != len(missing) {
+		return nil, fmt.Errorf("wrong batch result, len(in): %d, len(out): %d", len(missing), len(made))
+	}
+	for i, r := range made {
+		res[at[i]] = r
+		if data, err := json.Marshal(r); err == nil {
+			c.set(ctx, c.key(missing[i]), data)
+		}
+	}
+	return res, nil
+}
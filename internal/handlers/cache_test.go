@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLRUCache(t *testing.T) {
+	now := time.Now()
+	c := newLRUCache(2, time.Minute)
+	c.now = func() time.Time { return now }
+	c.set("a", []byte("1"))
+	c.set("b", []byte("2"))
+	if _, ok := c.get("a"); !ok {
+		t.Fatal("get(a) missing")
+	}
+	c.set("c", []byte("3"))
+	if _, ok := c.get("b"); ok {
+		t.Error("get(b) found, want evicted as least recently used")
+	}
+	if v, ok := c.get("a"); !ok || string(v) != "1" {
+		t.Errorf("get(a) = %s, %v", v, ok)
+	}
+	now = now.Add(2 * time.Minute)
+	if _, ok := c.get("c"); ok {
+		t.Error("get(c) found, want expired")
+	}
+}
+
+func TestCached(t *testing.T) {
+	c := &stageCache{name: "test", local: newLRUCache(10, time.Minute)}
+	calls := 0
+	f := func() (string, error) {
+		calls++
+		return "res", nil
+	}
+	for i := 0; i < 3; i++ {
+		got, err := cached(context.Background(), c, "in", f)
+		if err != nil || got != "res" {
+			t.Fatalf("cached() = %v, %v", got, err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("calls = %d, want 1", calls)
+	}
+}
@@ -29,7 +29,7 @@ func NewCleaner() (*Cleaner, error) {
 	return &res, nil
 }
 
-func (sp *Cleaner) Process(ctx context.Context, data *api.FullResult) (*api.FullResult, error) {
+func (sp *Cleaner) Process(ctx context.Context, state *SessionState, data *api.FullResult) (*api.FullResult, error) {
 	defer utils.MeasureTime("cleaner", time.Now())
 	if len(data.Result.Hypotheses) > 0 {
 		newText, err := sp.transform(data.Result.Hypotheses[0].Transcript)
@@ -47,3 +47,27 @@ func (sp *Cleaner) transform(text string) (string, error) {
 	text = sp.reSpaces.ReplaceAllString(text, " ")
 	return text, nil
 }
+
+// transformTexts implements textsTransformer
+func (sp *Cleaner) transformTexts(_ context.Context, texts []string) ([]string, error) {
+	res := make([]string, 0, len(texts))
+	for _, text := range texts {
+		t, err := sp.transform(text)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, t)
+	}
+	return res, nil
+}
+
+// mapTokens implements tokenMapper, words joined by _ are split keeping the source word
+func (sp *Cleaner) mapTokens(in, out []string) TokenMap {
+	var res TokenMap
+	for i, w := range in {
+		for range strings.Fields(strings.ReplaceAll(w, "_", " ")) {
+			res = append(res, TokenSpan{From: i, To: i + 1})
+		}
+	}
+	return res
+}
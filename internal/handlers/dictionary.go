@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/airenas/go-app/pkg/goapp"
+	"github.com/airenas/rt-transcriber-wrapper/internal/api"
+	"github.com/airenas/rt-transcriber-wrapper/internal/domain"
+	"github.com/airenas/rt-transcriber-wrapper/internal/utils"
+)
+
+// DictionaryGetter provides the replacement rules of a user
+type DictionaryGetter interface {
+	GetDictionary(ctx context.Context, userID string) (*domain.Dictionary, error)
+}
+
+// Dictionary replaces phrases by the user rules first and then by the global ones.
+// User rules are reloaded at most once per the reload interval, so edits apply during a session
+type Dictionary struct {
+	name   string
+	global []*replaceRule
+	getter DictionaryGetter
+	reload time.Duration
+}
+
+type replaceRule struct {
+	re           *regexp.Regexp
+	to           string
+	regex        bool
+	preserveCase bool
+}
+
+// userRules are the compiled rules of the session user
+type userRules struct {
+	lock   sync.Mutex
+	rules  []*replaceRule
+	loaded time.Time
+}
+
+// NewDictionary creates a replacement stage, reload of 0 defaults to 30s
+func NewDictionary(name string, global []domain.DictionaryRule, getter DictionaryGetter, reload time.Duration) (*Dictionary, error) {
+	if getter == nil {
+		return nil, fmt.Errorf("no dictionary getter")
+	}
+	res := &Dictionary{name: name, getter: getter, reload: reload}
+	if res.reload <= 0 {
+		res.reload = 30 * time.Second
+	}
+	var err error
+	if res.global, err = compileRules(global); err != nil {
+		return nil, fmt.Errorf("global rules: %w", err)
+	}
+	goapp.Log.Info().Str("name", name).Int("global", len(global)).Dur("reload", res.reload).Msg("Dictionary")
+	return res, nil
+}
+
+func (sp *Dictionary) Process(ctx context.Context, state *SessionState, data *api.FullResult) (*api.FullResult, error) {
+	defer utils.MeasureTime(sp.name, time.Now())
+	if len(data.Result.Hypotheses) == 0 {
+		return data, nil
+	}
+	text := data.Result.Hypotheses[0].Transcript
+	for _, r := range sp.userRules(ctx, state) {
+		text = r.apply(text)
+	}
+	for _, r := range sp.global {
+		text = r.apply(text)
+	}
+	data.Result.Hypotheses[0].Transcript = text
+	return data, nil
+}
+
+func (sp *Dictionary) userRules(ctx context.Context, state *SessionState) []*replaceRule {
+	if state.User == "" {
+		return nil
+	}
+	ur := state.Value(sp, func() any { return &userRules{} }).(*userRules)
+	ur.lock.Lock()
+	defer ur.lock.Unlock()
+	if time.Since(ur.loaded) < sp.reload {
+		return ur.rules
+	}
+	ur.loaded = time.Now()
+	dict, err := sp.getter.GetDictionary(ctx, state.User)
+	if err != nil {
+		goapp.Log.Error().Err(err).Str("stage", sp.name).Msg("can't load dictionary")
+		return ur.rules
+	}
+	rules, err := compileRules(dict.Rules)
+	if err != nil {
+		goapp.Log.Error().Err(err).Str("stage", sp.name).Msg("wrong dictionary")
+		return ur.rules
+	}
+	ur.rules = rules
+	return ur.rules
+}
+
+func compileRules(rules []domain.DictionaryRule) ([]*replaceRule, error) {
+	res := make([]*replaceRule, 0, len(rules))
+	for _, r := range rules {
+		if err := r.Validate(); err != nil {
+			return nil, err
+		}
+		expr := r.From
+		if !r.Regex {
+			words := strings.Fields(r.From)
+			for i, w := range words {
+				words[i] = regexp.QuoteMeta(w)
+			}
+			expr = "(?i)" + strings.Join(words, `\s+`)
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, &replaceRule{re: re, to: r.To, regex: r.Regex, preserveCase: r.PreserveCase})
+	}
+	return res, nil
+}
+
+// apply replaces the matches starting and ending at word boundaries
+func (r *replaceRule) apply(text string) string {
+	matches := r.re.FindAllStringSubmatchIndex(text, -1)
+	if len(matches) == 0 {
+		return text
+	}
+	res := strings.Builder{}
+	last := 0
+	for _, m := range matches {
+		if m[0] == m[1] || !wordBoundary(text, m[0]) || !wordBoundary(text, m[1]) {
+			continue
+		}
+		res.WriteString(text[last:m[0]])
+		to := r.to
+		if r.regex {
+			to = string(r.re.ExpandString(nil, r.to, text, m))
+		}
+		if r.preserveCase {
+			to = applyCase(text[m[0]:m[1]], to)
+		}
+		res.WriteString(to)
+		last = m[1]
+	}
+	res.WriteString(text[last:])
+	return res.String()
+}
+
+// wordBoundary tells if the position is not between two word characters
+func wordBoundary(text string, at int) bool {
+	before, _ := utf8.DecodeLastRuneInString(text[:at])
+	after, _ := utf8.DecodeRuneInString(text[at:])
+	return !isWordRune(before) || !isWordRune(after)
+}
+
+func isWordRune(r rune) bool {
+	return r != utf8.RuneError && (unicode.IsLetter(r) || unicode.IsDigit(r))
+}
+
+// applyCase makes to all upper if matched is, or capitalizes it if matched starts with an upper letter
+func applyCase(matched, to string) string {
+	if to == "" {
+		return to
+	}
+	letters, upper := 0, 0
+	for _, r := range matched {
+		if unicode.IsLetter(r) {
+			letters++
+			if unicode.IsUpper(r) {
+				upper++
+			}
+		}
+	}
+	if letters > 1 && upper == letters {
+		return strings.ToUpper(to)
+	}
+	first, _ := utf8.DecodeRuneInString(matched)
+	if unicode.IsUpper(first) {
+		r, n := utf8.DecodeRuneInString(to)
+		return string(unicode.ToUpper(r)) + to[n:]
+	}
+	return to
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/airenas/rt-transcriber-wrapper/internal/api"
+	"github.com/airenas/rt-transcriber-wrapper/internal/domain"
+)
+
+type testDictionaries map[string]*domain.Dictionary
+
+func (d testDictionaries) GetDictionary(_ context.Context, userID string) (*domain.Dictionary, error) {
+	if res, ok := d[userID]; ok {
+		return res, nil
+	}
+	return &domain.Dictionary{}, nil
+}
+
+func Test_replaceRule_apply(t *testing.T) {
+	tests := []struct {
+		name string
+		rule domain.DictionaryRule
+		in   string
+		want string
+	}{
+		{name: "phrase", rule: domain.DictionaryRule{From: "aspirinas", To: "Aspirin®"}, in: "gerti aspirinas, Aspirinas", want: "gerti Aspirin®, Aspirin®"},
+		{name: "word boundary", rule: domain.DictionaryRule{From: "as", To: "X"}, in: "as tas asas ąas as", want: "X tas asas ąas X"},
+		{name: "spaces", rule: domain.DictionaryRule{From: "ad  hoc", To: "ad-hoc"}, in: "tai ad hoc sprendimas", want: "tai ad-hoc sprendimas"},
+		{name: "preserve case", rule: domain.DictionaryRule{From: "šv", To: "šventasis", PreserveCase: true}, in: "šv Šv ŠV", want: "šventasis Šventasis ŠVENTASIS"},
+		{name: "regex", rule: domain.DictionaryRule{From: `(\d+) miligramų`, To: "${1} mg", Regex: true}, in: "po 20 miligramų", want: "po 20 mg"},
+		{name: "regex boundary", rule: domain.DictionaryRule{From: `\d+ kg`, To: "N", Regex: true}, in: "20 kgx", want: "20 kgx"},
+		{name: "metachars", rule: domain.DictionaryRule{From: "c++", To: "C++"}, in: "rašau c++", want: "rašau C++"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := compileRules([]domain.DictionaryRule{tt.rule})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := rules[0].apply(tt.in); got != tt.want {
+				t.Errorf("apply() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDictionary_Process(t *testing.T) {
+	dicts := testDictionaries{"u1": {Rules: []domain.DictionaryRule{{ID: "1", From: "a", To: "b"}}}}
+	d, err := NewDictionary("dictionary", []domain.DictionaryRule{{From: "b", To: "c"}, {From: "x", To: "y"}}, dicts, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		user string
+		want string
+	}{
+		{user: "u1", want: "c c y"},
+		{user: "u2", want: "a c y"},
+		{user: "", want: "a c y"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.user, func(t *testing.T) {
+			state := NewSessionState()
+			state.User = tt.user
+			res, err := d.Process(context.Background(), state, &api.FullResult{Result: api.Result{Hypotheses: []api.Hypothesis{{Transcript: "a b x"}}}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := res.Result.Hypotheses[0].Transcript; got != tt.want {
+				t.Errorf("Process() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/airenas/go-app/pkg/goapp"
+	"github.com/airenas/rt-transcriber-wrapper/internal/api"
+	"github.com/airenas/rt-transcriber-wrapper/internal/utils"
+)
+
+// HTTPStageConfig configures a text service call.
+// URL and Request are templates with .Text and the functions json (JSON string) and query (URL escaped)
+type HTTPStageConfig struct {
+	Name    string        `mapstructure:"-"`
+	URL     string        `mapstructure:"-"`
+	Timeout time.Duration `mapstructure:"-"`
+	// Method defaults to POST
+	Method  string            `mapstructure:"method"`
+	Headers map[string]string `mapstructure:"headers"`
+	// Request is the body template, empty sends no body
+	Request string `mapstructure:"request"`
+	// Response is the path of the result string in the JSON response, keys and array indexes separated by dots, e.g. data.0.text
+	Response  string          `mapstructure:"response"`
+	Transport TransportConfig `mapstructure:"transport"`
+}
+
+// HTTPStage transforms the transcript with any text service configured by HTTPStageConfig
+type HTTPStage struct {
+	httpclient *http.Client
+	name       string
+	method     string
+	url        *template.Template
+	request    *template.Template
+	headers    map[string]string
+	path       []string
+	timeout    time.Duration
+	cache      *stageCache
+}
+
+var templateFuncs = template.FuncMap{
+	"json": func(s string) (string, error) {
+		b, err := json.Marshal(s)
+		return string(b), err
+	},
+	"query": url.QueryEscape,
+}
+
+// NewHTTPStage creates a generic HTTP text stage
+func NewHTTPStage(cfg HTTPStageConfig) (*HTTPStage, error) {
+	res := HTTPStage{name: cfg.Name, headers: cfg.Headers}
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("no url")
+	}
+	if cfg.Response == "" {
+		return nil, fmt.Errorf("no response path")
+	}
+	var err error
+	if res.url, err = template.New("url").Funcs(templateFuncs).Parse(cfg.URL); err != nil {
+		return nil, fmt.Errorf("wrong url template: %w", err)
+	}
+	if cfg.Request != "" {
+		if res.request, err = template.New("request").Funcs(templateFuncs).Parse(cfg.Request); err != nil {
+			return nil, fmt.Errorf("wrong request template: %w", err)
+		}
+	}
+	res.method = strings.ToUpper(cfg.Method)
+	if res.method == "" {
+		res.method = http.MethodPost
+	}
+	res.path = strings.Split(cfg.Response, ".")
+	res.timeout = time.Second * 5
+	if cfg.Timeout > 0 {
+		res.timeout = cfg.Timeout
+	}
+	res.httpclient = &http.Client{Transport: newTransport(cfg.Transport)}
+	goapp.Log.Info().Str("name", cfg.Name).Str("method", res.method).Str("url", cfg.URL).Dur("timeout", res.timeout).Msg("HTTP stage")
+	return &res, nil
+}
+
+func (sp *HTTPStage) Process(ctx context.Context, state *SessionState, data *api.FullResult) (*api.FullResult, error) {
+	defer utils.MeasureTime(sp.name, time.Now())
+	if len(data.Result.Hypotheses) > 0 {
+		text := data.Result.Hypotheses[0].Transcript
+		newText, err := cached(ctx, sp.cache, text, func() (string, error) { return sp.transform(ctx, text) })
+		if err != nil {
+			return nil, err
+		}
+		data.Result.Hypotheses[0].Transcript = newText
+	}
+	return data, nil
+}
+
+// transformTexts implements textsTransformer
+func (sp *HTTPStage) transformTexts(ctx context.Context, texts []string) ([]string, error) {
+	res := make([]string, 0, len(texts))
+	for _, text := range texts {
+		r, err := cached(ctx, sp.cache, text, func() (string, error) { return sp.transform(ctx, text) })
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, r)
+	}
+	return res, nil
+}
+
+func (sp *HTTPStage) setCache(c *stageCache) {
+	sp.cache = c
+}
+
+func (sp *HTTPStage) transform(ctx context.Context, text string) (string, error) {
+	tData := struct{ Text string }{Text: text}
+	u := new(strings.Builder)
+	if err := sp.url.Execute(u, tData); err != nil {
+		return "", fmt.Errorf("can't make url: %w", err)
+	}
+	var body io.Reader
+	if sp.request != nil {
+		b := new(bytes.Buffer)
+		if err := sp.request.Execute(b, tData); err != nil {
+			return "", fmt.Errorf("can't make request: %w", err)
+		}
+		body = b
+	}
+	var res any
+	if err := callJSON(ctx, sp.httpclient, sp.method, u.String(), sp.headers, body, sp.timeout, &res); err != nil {
+		return "", err
+	}
+	return jsonPath(res, sp.path)
+}
+
+// jsonPath returns the string at the path of keys and array indexes
+func jsonPath(v any, path []string) (string, error) {
+	for i, p := range path {
+		switch t := v.(type) {
+		case map[string]any:
+			var ok bool
+			if v, ok = t[p]; !ok {
+				return "", fmt.Errorf("no '%s' in response", strings.Join(path[:i+1], "."))
+			}
+		case []any:
+			n, err := strconv.Atoi(p)
+			if err != nil || n < 0 || n >= len(t) {
+				return "", fmt.Errorf("no '%s' in response", strings.Join(path[:i+1], "."))
+			}
+			v = t[n]
+		default:
+			return "", fmt.Errorf("no '%s' in response", strings.Join(path[:i+1], "."))
+		}
+	}
+	res, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("'%s' is not a string", strings.Join(path, "."))
+	}
+	return res, nil
+}
@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/airenas/rt-transcriber-wrapper/internal/api"
+)
+
+func Test_jsonPath(t *testing.T) {
+	var v any
+	_ = json.Unmarshal([]byte(`{"result":"a","data":[{"text":"b"}],"n":1}`), &v)
+	tests := []struct {
+		path    []string
+		want    string
+		wantErr bool
+	}{
+		{path: []string{"result"}, want: "a"},
+		{path: []string{"data", "0", "text"}, want: "b"},
+		{path: []string{"data", "1", "text"}, wantErr: true},
+		{path: []string{"data", "x"}, wantErr: true},
+		{path: []string{"missing"}, wantErr: true},
+		{path: []string{"n"}, wantErr: true},
+		{path: []string{"result", "x"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := jsonPath(v, tt.path)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("jsonPath(%v) err = %v, wantErr %v", tt.path, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Errorf("jsonPath(%v) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestRegistry_httpStage(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		if r.Method != http.MethodPut || r.Header.Get("X-Key") != "k" || r.URL.Query().Get("lang") != "lt" ||
+			string(b) != `{"input":"a \"b\""}` {
+			http.Error(w, "wrong request", http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte(`{"out":{"texts":["a, b."]}}`))
+	}))
+	defer srv.Close()
+	h, err := NewRegistry().Build([]*StageConfig{{Name: "custom", Type: "http", URL: srv.URL + "?lang=lt",
+		Settings: map[string]any{"method": "put", "headers": map[string]any{"x-key": "k"},
+			"request": `{"input":{{json .Text}}}`, "response": "out.texts.0",
+			"transport": map[string]any{"maxconnsperhost": 1, "idleconntimeout": "1s"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := h.Process(context.Background(), NewSessionState(), &api.FullResult{Result: api.Result{Hypotheses: []api.Hypothesis{{Transcript: `a "b"`}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Result.Hypotheses[0].Transcript != "a, b." {
+		t.Errorf("Process() = %q, want %q", got.Result.Hypotheses[0].Transcript, "a, b.")
+	}
+}
@@ -2,6 +2,10 @@ package handlers
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/airenas/go-app/pkg/goapp"
@@ -10,12 +14,24 @@ import (
 )
 
 type Handler interface {
-	Process(context.Context, *api.FullResult) (*api.FullResult, error)
+	Process(context.Context, *SessionState, *api.FullResult) (*api.FullResult, error)
+}
+
+type stage struct {
+	name     string
+	handler  Handler
+	partials bool
+	async    bool
+	// nBest hypotheses are processed, alternatives with texts
+	nBest int
+	texts textsTransformer
 }
 
 // List passes data to list of middleware
 type ListHandler struct {
-	hadlers []Handler
+	stages []*stage
+	// partialInterval is the minimal interval between processed partials of a segment
+	partialInterval time.Duration
 }
 
 func NewListHandler() (*ListHandler, error) {
@@ -23,22 +39,150 @@ func NewListHandler() (*ListHandler, error) {
 	return res, nil
 }
 
-func (sp *ListHandler) Process(ctx context.Context, data *api.FullResult) (*api.FullResult, error) {
+func (sp *ListHandler) Process(ctx context.Context, state *SessionState, data *api.FullResult) (*api.FullResult, error) {
 	defer utils.MeasureTime("process", time.Now())
 	dataCopy := data
-	for i, h := range sp.hadlers {
-		goapp.Log.Debug().Int("handler", i).Msg("Processing")
-		if dataNew, err := h.Process(ctx, dataCopy); err != nil {
-			goapp.Log.Error().Err(err).Msg("Can't process")
+	var align *alignment
+	if data.Result.Final && len(data.Result.Hypotheses) > 0 && len(data.Result.Hypotheses[0].WordAlignment) > 0 {
+		align = newAlignment(&data.Result.Hypotheses[0])
+	}
+	for _, s := range sp.stages {
+		if !s.partials && !dataCopy.Result.Final {
+			continue
+		}
+		goapp.Log.Debug().Str("handler", s.name).Msg("Processing")
+		before := transcriptTokens(dataCopy)
+		dataNew, ok, err := processStage(ctx, s.handler, state, dataCopy)
+		if err != nil {
+			if errors.Is(err, ErrStageFailed) {
+				return nil, err
+			}
+			goapp.Log.Error().Err(err).Str("handler", s.name).Msg("Can't process")
 		} else {
 			dataCopy = dataNew
 		}
-		goapp.Log.Debug().Int("handler", i).Msg("Finished")
+		// alternatives are skipped if the top hypothesis failed, the service is likely down
+		if s.texts != nil && ok {
+			if err := sp.processAlternatives(ctx, s, dataCopy); err != nil {
+				return nil, err
+			}
+		}
+		if align != nil {
+			align.apply(s.handler, before, transcriptTokens(dataCopy))
+		}
+		goapp.Log.Debug().Str("handler", s.name).Msg("Finished")
+	}
+	if align != nil && len(dataCopy.Result.Hypotheses) > 0 {
+		dataCopy.Result.Hypotheses[0].WordAlignment = align.result(transcriptTokens(dataCopy))
 	}
 	dataCopy.Event = "TRANSCRIPTION"
 	return dataCopy, nil
 }
 
+func transcriptTokens(data *api.FullResult) []string {
+	if len(data.Result.Hypotheses) == 0 {
+		return nil
+	}
+	return strings.Fields(data.Result.Hypotheses[0].Transcript)
+}
+
+// processStage runs the handler, ok tells if the stage succeeded and not its failure policy
+func processStage(ctx context.Context, h Handler, state *SessionState, data *api.FullResult) (*api.FullResult, bool, error) {
+	if g, ok := h.(*guardedStage); ok {
+		return g.process(ctx, state, data)
+	}
+	res, err := h.Process(ctx, state, data)
+	return res, err == nil, err
+}
+
+// processAlternatives transforms the hypotheses after the top one, failures keep them unchanged
+// unless the stage is fail-closed
+func (sp *ListHandler) processAlternatives(ctx context.Context, s *stage, data *api.FullResult) error {
+	hyps := data.Result.Hypotheses
+	n := len(hyps)
+	if s.nBest > 0 {
+		n = min(n, s.nBest)
+	}
+	if n < 2 {
+		return nil
+	}
+	texts := make([]string, 0, n-1)
+	for _, h := range hyps[1:n] {
+		texts = append(texts, h.Transcript)
+	}
+	res, err := s.texts.transformTexts(ctx, texts)
+	if errors.Is(err, ErrStageFailed) {
+		return err
+	}
+	if err == nil && len(res) != len(texts) {
+		err = fmt.Errorf("wrong result, len(in): %d, len(out): %d", len(texts), len(res))
+	}
+	if err != nil {
+		goapp.Log.Error().Err(err).Str("handler", s.name).Msg("Can't process alternatives")
+		return nil
+	}
+	for i, t := range res {
+		hyps[i+1].Transcript = t
+	}
+	return nil
+}
+
+// setNBest makes the last added stage process n hypotheses, -1 - all, a guarded stage applies its policy to them too
+func (sp *ListHandler) setNBest(n int, h Handler) error {
+	if n < -1 {
+		return fmt.Errorf("wrong nBest %d", n)
+	}
+	if _, ok := unwrap(h).(textsTransformer); !ok {
+		return fmt.Errorf("stage does not support nBest")
+	}
+	s := sp.stages[len(sp.stages)-1]
+	s.nBest, s.texts = n, h.(textsTransformer)
+	return nil
+}
+
+// Add appends a handler for all results
 func (sp *ListHandler) Add(h Handler) {
-	sp.hadlers = append(sp.hadlers, h)
+	sp.AddStage(strconv.Itoa(len(sp.stages)), h, true)
+}
+
+// AddStage appends a named handler, partials false skips it for partial results
+func (sp *ListHandler) AddStage(name string, h Handler, partials bool) {
+	sp.stages = append(sp.stages, &stage{name: name, handler: h, partials: partials})
+}
+
+// AddAsyncStage appends a handler that runs with all following stages in background
+func (sp *ListHandler) AddAsyncStage(name string, h Handler, partials bool) {
+	sp.stages = append(sp.stages, &stage{name: name, handler: h, partials: partials, async: true})
+}
+
+// SetPartialInterval sets the minimal interval between processed partials of a segment, finals are always processed
+func (sp *ListHandler) SetPartialInterval(d time.Duration) {
+	sp.partialInterval = d
+}
+
+// PartialInterval implements partialLimiter
+func (sp *ListHandler) PartialInterval() time.Duration {
+	return sp.partialInterval
+}
+
+// PartialStages returns the number of stages called for a partial result
+func (sp *ListHandler) PartialStages() int {
+	res := 0
+	for _, s := range sp.stages {
+		if s.partials {
+			res++
+		}
+	}
+	return res
+}
+
+// Split divides the pipeline at the first async stage
+func (sp *ListHandler) Split() (Handler, Handler) {
+	for i, s := range sp.stages {
+		if s.async {
+			return &ListHandler{stages: sp.stages[:i], partialInterval: sp.partialInterval},
+				&ListHandler{stages: sp.stages[i:]}
+		}
+	}
+	return sp, nil
 }
@@ -0,0 +1,228 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/airenas/go-app/pkg/goapp"
+	"github.com/airenas/rt-transcriber-wrapper/internal/api"
+	"github.com/airenas/rt-transcriber-wrapper/internal/domain"
+	"github.com/airenas/rt-transcriber-wrapper/internal/utils"
+)
+
+// UserConfigGetter provides the user config
+type UserConfigGetter interface {
+	GetConfig(ctx context.Context, userID string) (*domain.User, error)
+}
+
+// MaskerConfig configures masking of sensitive terms
+type MaskerConfig struct {
+	Name string `mapstructure:"-"`
+	// Terms are matched case insensitively: word* - any word with the prefix,
+	// word - the word in any inflection, its Lithuanian ending is ignored
+	Terms []string `mapstructure:"terms"`
+	// File has more terms, one per line, lines starting with # are skipped
+	File string `mapstructure:"file"`
+	// Placeholder replaces the word, *** by default
+	Placeholder string `mapstructure:"placeholder"`
+	// Enabled is used for users without the masking setting in their config
+	Enabled bool `mapstructure:"enabled"`
+	// Reload is the interval of reading the user config, 30s by default
+	Reload time.Duration `mapstructure:"reload"`
+}
+
+// Masker replaces sensitive words in all hypotheses with a placeholder and reports their positions in Hypothesis.Masked.
+// It should be the last stage, as positions are indexes of the words split by spaces
+type Masker struct {
+	name        string
+	prefixes    map[string]bool
+	stems       map[string]bool
+	maxPrefix   int
+	placeholder string
+	enabled     bool
+	configs     UserConfigGetter
+	reload      time.Duration
+}
+
+// userMasking keeps the masking setting of the session user
+type userMasking struct {
+	lock    sync.Mutex
+	enabled bool
+	loaded  time.Time
+}
+
+// ltEndings are Lithuanian inflection endings, the longest ones first
+var ltEndings = []string{"iuose", "ijos", "iams", "iems", "ioms", "uose",
+	"ams", "ems", "oms", "ėms", "ims", "ums", "yse", "ose", "ėse", "yje", "oje", "ėje", "uje", "ais",
+	"iai", "iui", "ius", "ija", "iją", "ijų", "ių", "io", "ia", "ią", "iu", "ie",
+	"as", "is", "ys", "us", "ai", "ui", "os", "ės",
+	"ą", "ę", "į", "ų", "a", "ė", "o", "e", "i", "u", "y"}
+
+// minStem keeps short words from matching each other after the ending is cut
+const minStem = 3
+
+// NewMasker creates a masking stage
+func NewMasker(cfg MaskerConfig, configs UserConfigGetter) (*Masker, error) {
+	if configs == nil {
+		return nil, fmt.Errorf("no config getter")
+	}
+	res := &Masker{name: cfg.Name, prefixes: map[string]bool{}, stems: map[string]bool{}, placeholder: cfg.Placeholder,
+		enabled: cfg.Enabled, configs: configs, reload: cfg.Reload}
+	if res.placeholder == "" {
+		res.placeholder = "***"
+	}
+	if strings.ContainsFunc(res.placeholder, unicode.IsSpace) {
+		return nil, fmt.Errorf("placeholder can't contain spaces")
+	}
+	if res.reload <= 0 {
+		res.reload = 30 * time.Second
+	}
+	terms := cfg.Terms
+	if cfg.File != "" {
+		fileTerms, err := readTerms(cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, fileTerms...)
+	}
+	for _, t := range terms {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if prefix, ok := strings.CutSuffix(t, "*"); ok {
+			if prefix == "" {
+				return nil, fmt.Errorf("empty prefix term")
+			}
+			res.prefixes[prefix] = true
+			res.maxPrefix = max(res.maxPrefix, len(prefix))
+		} else if t != "" {
+			res.stems[stem(t)] = true
+		}
+	}
+	if len(res.prefixes)+len(res.stems) == 0 {
+		return nil, fmt.Errorf("no terms")
+	}
+	goapp.Log.Info().Str("name", cfg.Name).Int("prefixes", len(res.prefixes)).Int("words", len(res.stems)).
+		Bool("enabled", cfg.Enabled).Msg("Masker")
+	return res, nil
+}
+
+func readTerms(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("can't open terms: %w", err)
+	}
+	defer f.Close()
+	var res []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if l := strings.TrimSpace(s.Text()); l != "" && !strings.HasPrefix(l, "#") {
+			res = append(res, l)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("can't read terms: %w", err)
+	}
+	return res, nil
+}
+
+func (sp *Masker) Process(ctx context.Context, state *SessionState, data *api.FullResult) (*api.FullResult, error) {
+	defer utils.MeasureTime(sp.name, time.Now())
+	if len(data.Result.Hypotheses) == 0 || !sp.isEnabled(ctx, state) {
+		return data, nil
+	}
+	for i := range data.Result.Hypotheses {
+		h := &data.Result.Hypotheses[i]
+		h.Transcript, h.Masked = sp.mask(h.Transcript)
+	}
+	for i, u := range data.OldUpdates {
+		c := *u
+		c.Transcript, c.Masked = sp.mask(u.Transcript)
+		data.OldUpdates[i] = &c
+	}
+	return data, nil
+}
+
+// mapTokens implements tokenMapper, masking keeps the words one to one
+func (sp *Masker) mapTokens(in, out []string) TokenMap {
+	if len(in) != len(out) {
+		return nil
+	}
+	return identityMap(len(in))
+}
+
+func (sp *Masker) isEnabled(ctx context.Context, state *SessionState) bool {
+	if state.User == "" {
+		return sp.enabled
+	}
+	um := state.Value(sp, func() any { return &userMasking{enabled: sp.enabled} }).(*userMasking)
+	um.lock.Lock()
+	defer um.lock.Unlock()
+	if time.Since(um.loaded) < sp.reload {
+		return um.enabled
+	}
+	um.loaded = time.Now()
+	user, err := sp.configs.GetConfig(ctx, state.User)
+	if err != nil {
+		goapp.Log.Error().Err(err).Str("stage", sp.name).Msg("can't load user config")
+		return um.enabled
+	}
+	um.enabled = sp.enabled
+	if user.Masking != nil {
+		um.enabled = *user.Masking
+	}
+	return um.enabled
+}
+
+// mask replaces the matching words keeping the surrounding punctuation, returns indexes of masked words
+func (sp *Masker) mask(text string) (string, []int) {
+	words := strings.Fields(text)
+	var masked []int
+	for i, w := range words {
+		start := strings.IndexFunc(w, isWordRune)
+		if start < 0 {
+			continue
+		}
+		end := strings.LastIndexFunc(w, isWordRune)
+		_, n := utf8.DecodeRuneInString(w[end:])
+		end += n
+		if sp.matches(strings.ToLower(w[start:end])) {
+			words[i] = w[:start] + sp.placeholder + w[end:]
+			masked = append(masked, i)
+		}
+	}
+	if len(masked) == 0 {
+		return text, nil
+	}
+	return strings.Join(words, " "), masked
+}
+
+func (sp *Masker) matches(word string) bool {
+	if sp.stems[stem(word)] {
+		return true
+	}
+	for i := range word {
+		if i > sp.maxPrefix {
+			break
+		}
+		if i > 0 && sp.prefixes[word[:i]] {
+			return true
+		}
+	}
+	return sp.prefixes[word]
+}
+
+// stem cuts the longest Lithuanian ending leaving at least minStem letters
+func stem(word string) string {
+	for _, e := range ltEndings {
+		if s, ok := strings.CutSuffix(word, e); ok && utf8.RuneCountInString(s) >= minStem {
+			return s
+		}
+	}
+	return word
+}
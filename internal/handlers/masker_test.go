@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/airenas/rt-transcriber-wrapper/internal/api"
+	"github.com/airenas/rt-transcriber-wrapper/internal/domain"
+)
+
+type testConfigs map[string]*domain.User
+
+func (c testConfigs) GetConfig(_ context.Context, userID string) (*domain.User, error) {
+	if res, ok := c[userID]; ok {
+		return res, nil
+	}
+	return &domain.User{}, nil
+}
+
+func TestMasker_mask(t *testing.T) {
+	m, err := NewMasker(MaskerConfig{Terms: []string{"kvailys", "šūd*"}}, testConfigs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		in         string
+		want       string
+		wantMasked []int
+	}{
+		{name: "none", in: "labas rytas", want: "labas rytas"},
+		{name: "exact", in: "tu kvailys", want: "tu ***", wantMasked: []int{1}},
+		{name: "inflection", in: "kvailio kvailiui Kvailiams", want: "*** *** ***", wantMasked: []int{0, 1, 2}},
+		{name: "prefix", in: "šūdas ir Šūdinas", want: "*** ir ***", wantMasked: []int{0, 2}},
+		{name: "punctuation", in: "(kvailys), sakė", want: "(***), sakė", wantMasked: []int{0}},
+		{name: "other words", in: "kvailumas kvadratas šuo", want: "kvailumas kvadratas šuo"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, masked := m.mask(tt.in)
+			if got != tt.want {
+				t.Errorf("mask() = %q, want %q", got, tt.want)
+			}
+			if !reflect.DeepEqual(masked, tt.wantMasked) {
+				t.Errorf("mask() masked = %v, want %v", masked, tt.wantMasked)
+			}
+		})
+	}
+}
+
+func TestMasker_Process(t *testing.T) {
+	off, on := false, true
+	configs := testConfigs{"off": {Masking: &off}, "on": {Masking: &on}}
+	tests := []struct {
+		name    string
+		enabled bool
+		user    string
+		want    string
+	}{
+		{name: "default on", enabled: true, user: "u", want: "*** ir"},
+		{name: "default off", enabled: false, user: "u", want: "kvailys ir"},
+		{name: "user off", enabled: true, user: "off", want: "kvailys ir"},
+		{name: "user on", enabled: false, user: "on", want: "*** ir"},
+		{name: "no user", enabled: true, want: "*** ir"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := NewMasker(MaskerConfig{Name: "mask", Terms: []string{"kvailys"}, Enabled: tt.enabled}, configs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			state := NewSessionState()
+			state.User = tt.user
+			res, err := m.Process(context.Background(), state, &api.FullResult{
+				Result:     api.Result{Hypotheses: []api.Hypothesis{{Transcript: "kvailys ir"}}},
+				OldUpdates: []*api.ShortResult{{Segment: 1, Transcript: "kvailys ir"}}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := res.Result.Hypotheses[0].Transcript; got != tt.want {
+				t.Errorf("Process() = %q, want %q", got, tt.want)
+			}
+			if got := res.OldUpdates[0].Transcript; got != tt.want {
+				t.Errorf("Process() update = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMasker_Process_nBest(t *testing.T) {
+	m, err := NewMasker(MaskerConfig{Name: "mask", Terms: []string{"kvailys"}, Enabled: true}, testConfigs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := m.Process(context.Background(), NewSessionState(), &api.FullResult{Result: api.Result{
+		Hypotheses: []api.Hypothesis{{Transcript: "tu kvailys"}, {Transcript: "kvailio tu"}, {Transcript: "tu kvailiai"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []api.Hypothesis{{Transcript: "tu ***", Masked: []int{1}}, {Transcript: "*** tu", Masked: []int{0}},
+		{Transcript: "tu ***", Masked: []int{1}}}
+	if !reflect.DeepEqual(res.Result.Hypotheses, want) {
+		t.Errorf("Process() = %v, want %v", res.Result.Hypotheses, want)
+	}
+}
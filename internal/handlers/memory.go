@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"time"
+
+	"github.com/airenas/go-app/pkg/goapp"
+	"github.com/airenas/rt-transcriber-wrapper/internal/api"
+	"github.com/airenas/rt-transcriber-wrapper/internal/utils"
+)
+
+// segmentMemory is the windowed punctuator memory of one session.
+// It keeps only the segments the punctuation context can still reach and reports its size to metrics
+type segmentMemory struct {
+	utils.CustomData
+	words, segments, peak int
+	evicted               int
+	// pending keeps IDs of corrected segments not sent yet
+	pending    map[int]bool
+	lastUpdate time.Time
+}
+
+func newSegmentMemory() *segmentMemory {
+	memorySessions.Inc()
+	return &segmentMemory{}
+}
+
+// shrink evicts segments not needed to hold keepWords final words and updates the metrics
+func (m *segmentMemory) shrink(keepWords int) {
+	if n := m.Evict(keepWords); n > 0 {
+		m.evicted += n
+		segmentsEvicted.Add(float64(n))
+	}
+	words, segments := m.Words(), len(m.Segments)
+	memoryWords.Add(float64(words - m.words))
+	memorySegments.Add(float64(segments - m.segments))
+	m.words, m.segments = words, segments
+	m.peak = max(m.peak, words)
+}
+
+// updates returns corrections of previous segments, at most one batch per interval.
+// Postponed corrections are merged with later ones and always sent with a final result
+func (m *segmentMemory) updates(changed []*api.ShortResult, final bool, interval time.Duration) []*api.ShortResult {
+	for _, c := range changed {
+		if m.pending == nil {
+			m.pending = map[int]bool{}
+		}
+		m.pending[c.Segment] = true
+	}
+	if len(m.pending) == 0 {
+		return nil
+	}
+	now := time.Now()
+	if !final && interval > 0 && now.Sub(m.lastUpdate) < interval {
+		updatesDelayed.Add(float64(len(changed)))
+		return nil
+	}
+	var res []*api.ShortResult
+	for _, s := range m.Segments {
+		if m.pending[s.ID] {
+			res = append(res, &api.ShortResult{Segment: s.ID, Transcript: getSegmentText(s), Final: s.Final})
+		}
+	}
+	clear(m.pending)
+	m.lastUpdate = now
+	return res
+}
+
+// Close removes the session memory from metrics
+func (m *segmentMemory) Close() error {
+	memoryWords.Sub(float64(m.words))
+	memorySegments.Sub(float64(m.segments))
+	memorySessions.Dec()
+	memoryPeakWords.Observe(float64(m.peak))
+	goapp.Log.Debug().Int("words", m.words).Int("peak", m.peak).Int("evicted", m.evicted).Msg("segment memory released")
+	m.words, m.segments = 0, 0
+	return nil
+}
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/airenas/rt-transcriber-wrapper/internal/api"
+	"github.com/airenas/rt-transcriber-wrapper/internal/utils"
+)
+
+func testSegment(id int, final bool, words ...string) *utils.Segments {
+	res := &utils.Segments{ID: id, Final: final}
+	for _, w := range words {
+		res.Processed = append(res.Processed, &utils.ProcessData{Original: w, Punctuated: w})
+	}
+	return res
+}
+
+func TestSegmentMemory_shrink(t *testing.T) {
+	tests := []struct {
+		name     string
+		segments []*utils.Segments
+		keep     int
+		wantIDs  []int
+	}{
+		{name: "empty", keep: 3, wantIDs: nil},
+		{name: "fits", keep: 3, segments: []*utils.Segments{testSegment(1, true, "a"), testSegment(2, true, "b", "c")},
+			wantIDs: []int{1, 2}},
+		{name: "evicts", keep: 3, segments: []*utils.Segments{testSegment(1, true, "a"), testSegment(2, true, "b"),
+			testSegment(3, true, "c", "d"), testSegment(4, true, "e", "f")}, wantIDs: []int{3, 4}},
+		{name: "skips partial words", keep: 2, segments: []*utils.Segments{testSegment(1, true, "a"),
+			testSegment(2, true, "b"), testSegment(3, false, "c", "d")}, wantIDs: []int{1, 2, 3}},
+		{name: "drops unfinished", keep: 1, segments: []*utils.Segments{testSegment(1, false, "a"),
+			testSegment(2, true, "b"), testSegment(3, false, "c")}, wantIDs: []int{2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newSegmentMemory()
+			defer m.Close()
+			m.Segments = tt.segments
+			m.shrink(tt.keep)
+			var got []int
+			for _, s := range m.Segments {
+				got = append(got, s.ID)
+			}
+			if len(got) != len(tt.wantIDs) {
+				t.Fatalf("shrink() = %v, want %v", got, tt.wantIDs)
+			}
+			for i := range got {
+				if got[i] != tt.wantIDs[i] {
+					t.Errorf("shrink() = %v, want %v", got, tt.wantIDs)
+				}
+			}
+			if m.words != m.Words() {
+				t.Errorf("shrink() words = %d, want %d", m.words, m.Words())
+			}
+		})
+	}
+}
+
+func TestSegmentMemory_updates(t *testing.T) {
+	m := newSegmentMemory()
+	defer m.Close()
+	m.Segments = []*utils.Segments{testSegment(1, true, "a."), testSegment(2, true, "b"), testSegment(3, false, "c")}
+	if got := m.updates([]*api.ShortResult{{Segment: 1}}, false, time.Minute); len(got) != 1 {
+		t.Fatalf("updates() = %d, want the first update at once", len(got))
+	}
+	if got := m.updates([]*api.ShortResult{{Segment: 2}}, false, time.Minute); len(got) != 0 {
+		t.Fatalf("updates() = %d, want postponed", len(got))
+	}
+	got := m.updates([]*api.ShortResult{{Segment: 1}}, true, time.Minute)
+	if len(got) != 2 || got[0].Segment != 1 || got[1].Segment != 2 || got[0].Transcript != "a." {
+		t.Errorf("updates() = %v, want merged 1, 2 on final", got)
+	}
+	if got := m.updates(nil, true, time.Minute); len(got) != 0 {
+		t.Errorf("updates() = %d, want none", len(got))
+	}
+}
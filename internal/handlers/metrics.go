@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	breakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "wrapper", Name: "stage_breaker_state",
+		Help: "Circuit breaker state of the stage: 0 - closed, 1 - half open, 2 - open",
+	}, []string{"stage"})
+	breakerChanges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "wrapper", Name: "stage_breaker_changes_total",
+		Help: "Circuit breaker state changes",
+	}, []string{"stage", "state"})
+	stageFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "wrapper", Name: "stage_failures_total",
+		Help: "Failed stage calls by the applied policy",
+	}, []string{"stage", "policy"})
+	partialsSkipped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "wrapper", Name: "partials_skipped_total",
+		Help: "Partial results not processed: debounce - within the minimal interval, stale - replaced by a newer one",
+	}, []string{"reason"})
+	cacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "wrapper", Name: "stage_cache_requests_total",
+		Help: "Stage cache lookups by result: hit, shared_hit or miss",
+	}, []string{"stage", "result"})
+	callsSaved = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "wrapper", Name: "stage_calls_saved_total",
+		Help: "Stage calls saved by skipping partial results",
+	})
+	memorySessions = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "wrapper", Name: "segment_memory_sessions",
+		Help: "Sessions holding punctuator segment memory",
+	})
+	memoryWords = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "wrapper", Name: "segment_memory_words",
+		Help: "Words kept in punctuator segment memory of all sessions",
+	})
+	memorySegments = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "wrapper", Name: "segment_memory_segments",
+		Help: "Segments kept in punctuator segment memory of all sessions",
+	})
+	memoryPeakWords = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "wrapper", Name: "segment_memory_peak_words",
+		Help:    "Maximum words kept in segment memory of one session",
+		Buckets: prometheus.ExponentialBuckets(10, 2, 10),
+	})
+	segmentsEvicted = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "wrapper", Name: "segment_memory_evicted_total",
+		Help: "Final segments evicted from segment memory",
+	})
+	updatesDelayed = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "wrapper", Name: "punctuator_updates_delayed_total",
+		Help: "Corrections of previous segments postponed by the update interval",
+	})
+	processRestarts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "wrapper", Name: "stage_process_restarts_total",
+		Help: "Restarts of external stage processes after a crash or timeout",
+	}, []string{"stage"})
+)
@@ -0,0 +1,22 @@
+package handlers
+
+import "context"
+
+// textsTransformer is implemented by stages able to process alternative hypotheses.
+// The texts are independent of the session, so the segment memory follows the top hypothesis only
+type textsTransformer interface {
+	transformTexts(ctx context.Context, texts []string) ([]string, error)
+}
+
+// unwrap returns the stage handler without the failure policy
+func unwrap(h Handler) Handler {
+	if g, ok := h.(*guardedStage); ok {
+		return g.handler
+	}
+	return h
+}
+
+// batchRequest is sent to the services supporting many texts in one call
+type batchRequest struct {
+	Texts []string `json:"texts"`
+}
@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/airenas/rt-transcriber-wrapper/internal/api"
+)
+
+type upperStage struct{}
+
+func (s *upperStage) Process(_ context.Context, _ *SessionState, data *api.FullResult) (*api.FullResult, error) {
+	data.Result.Hypotheses[0].Transcript = strings.ToUpper(data.Result.Hypotheses[0].Transcript)
+	return data, nil
+}
+
+func (s *upperStage) transformTexts(_ context.Context, texts []string) ([]string, error) {
+	res := make([]string, 0, len(texts))
+	for _, t := range texts {
+		res = append(res, strings.ToUpper(t))
+	}
+	return res, nil
+}
+
+func TestRegistry_Build_nBest(t *testing.T) {
+	r := NewRegistry()
+	r.Register("upper", func(cfg *StageConfig) (Handler, error) { return &upperStage{}, nil })
+	r.Register("test", func(cfg *StageConfig) (Handler, error) { return &testStage{}, nil })
+	tests := []struct {
+		name    string
+		stage   *StageConfig
+		want    []string
+		wantErr bool
+	}{
+		{name: "top", stage: &StageConfig{Name: "upper"}, want: []string{"A", "b", "c"}},
+		{name: "top k", stage: &StageConfig{Name: "upper", NBest: 2}, want: []string{"A", "B", "c"}},
+		{name: "all", stage: &StageConfig{Name: "upper", NBest: -1}, want: []string{"A", "B", "C"}},
+		{name: "with policy", stage: &StageConfig{Name: "upper", NBest: -1, Policy: Policy{Retries: 1}}, want: []string{"A", "B", "C"}},
+		{name: "wrong", stage: &StageConfig{Name: "upper", NBest: -2}, wantErr: true},
+		{name: "not supported", stage: &StageConfig{Name: "test", NBest: 2}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := r.Build([]*StageConfig{tt.stage})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Build() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			res, _ := h.Process(context.Background(), NewSessionState(), &api.FullResult{Result: api.Result{
+				Hypotheses: []api.Hypothesis{{Transcript: "a"}, {Transcript: "b"}, {Transcript: "c"}}}})
+			var got []string
+			for _, h := range res.Result.Hypotheses {
+				got = append(got, h.Transcript)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Process() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+type failingTexts struct {
+	failingStage
+	textCalls int
+}
+
+func (s *failingTexts) transformTexts(_ context.Context, texts []string) ([]string, error) {
+	s.textCalls++
+	return texts, nil
+}
+
+func TestRegistry_Build_nBestBreaker(t *testing.T) {
+	tests := []struct {
+		name          string
+		policy        Policy
+		fails         int
+		wantErr       error
+		wantCalls     int
+		wantTextCalls int
+	}{
+		{name: "ok", policy: Policy{BreakerFailures: 1}, wantCalls: 3, wantTextCalls: 3},
+		{name: "breaker open", policy: Policy{BreakerFailures: 1}, fails: 1, wantCalls: 1},
+		{name: "closed", policy: Policy{OnError: PolicyClosed, BreakerFailures: 1}, fails: 1, wantErr: ErrStageFailed, wantCalls: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &failingTexts{failingStage: failingStage{fails: tt.fails}}
+			r := NewRegistry()
+			r.Register("failing", func(cfg *StageConfig) (Handler, error) { return s, nil })
+			h, err := r.Build([]*StageConfig{{Name: "failing", NBest: -1, Policy: tt.policy}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for range 3 {
+				_, err := h.Process(context.Background(), NewSessionState(), &api.FullResult{Result: api.Result{
+					Hypotheses: []api.Hypothesis{{Transcript: "a"}, {Transcript: "b"}}}})
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("Process() err = %v, want %v", err, tt.wantErr)
+				}
+			}
+			if s.calls != tt.wantCalls {
+				t.Errorf("Process() calls = %d, want %d", s.calls, tt.wantCalls)
+			}
+			if s.textCalls != tt.wantTextCalls {
+				t.Errorf("transformTexts() calls = %d, want %d", s.textCalls, tt.wantTextCalls)
+			}
+		})
+	}
+}
+
+func TestJoiner_transformTexts_batch(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		var req batchRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		res := batchResponse{}
+		for _, t := range req.Texts {
+			res.Results = append(res.Results, strings.ToUpper(t))
+		}
+		_ = json.NewEncoder(w).Encode(res)
+	}))
+	defer srv.Close()
+	j, err := NewJoiner(srv.URL, time.Second, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.setCache(&stageCache{name: "joiner", local: newLRUCache(10, time.Minute)})
+	for _, tt := range []struct {
+		texts     []string
+		wantCalls int
+	}{
+		{texts: []string{"a", "b"}, wantCalls: 1},
+		{texts: []string{"b", "c"}, wantCalls: 2},
+		{texts: []string{"a", "c"}, wantCalls: 2},
+	} {
+		got, err := j.transformTexts(context.Background(), tt.texts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := strings.Split(strings.ToUpper(strings.Join(tt.texts, ",")), ","); !reflect.DeepEqual(got, want) {
+			t.Errorf("transformTexts() = %v, want %v", got, want)
+		}
+		if calls != tt.wantCalls {
+			t.Errorf("transformTexts() calls = %d, want %d", calls, tt.wantCalls)
+		}
+	}
+}
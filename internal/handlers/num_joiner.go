@@ -19,25 +19,33 @@ type Joiner struct {
 	httpclient *http.Client
 	getURL     string
 	timeout    time.Duration
+	cache      *stageCache
+	// batch sends alternatives in one call
+	batch bool
 }
 
-// NewClient creates a transcriber client
-func NewJoiner(getURL string) (*Joiner, error) {
+// NewJoiner creates a number joiner middleware, batch enables {"texts": [...]} -> {"results": [...]} calls for alternatives
+func NewJoiner(getURL string, timeout time.Duration, batch bool) (*Joiner, error) {
 	res := Joiner{}
 	if getURL == "" {
 		return nil, fmt.Errorf("no getURL")
 	}
 	res.getURL = getURL
+	res.batch = batch
 	res.timeout = time.Second * 3
+	if timeout > 0 {
+		res.timeout = timeout
+	}
 	res.httpclient = asrHTTPClient()
-	goapp.Log.Info().Str("url", getURL).Msg("Joiner")
+	goapp.Log.Info().Str("url", getURL).Dur("timeout", res.timeout).Msg("Joiner")
 	return &res, nil
 }
 
-func (sp *Joiner) Process(ctx context.Context, data *api.FullResult) (*api.FullResult, error) {
+func (sp *Joiner) Process(ctx context.Context, state *SessionState, data *api.FullResult) (*api.FullResult, error) {
 	defer utils.MeasureTime("joiner", time.Now())
 	if len(data.Result.Hypotheses) > 0 {
-		newText, err := sp.transform(ctx, data.Result.Hypotheses[0].Transcript)
+		text := data.Result.Hypotheses[0].Transcript
+		newText, err := cached(ctx, sp.cache, text, func() (string, error) { return sp.transform(ctx, text) })
 		if err != nil {
 			return nil, err
 		}
@@ -46,38 +54,85 @@ func (sp *Joiner) Process(ctx context.Context, data *api.FullResult) (*api.FullR
 	return data, nil
 }
 
+// mapTokens implements tokenMapper, the service returns the text only, so words are aligned by matching
+func (sp *Joiner) mapTokens(in, out []string) TokenMap {
+	return alignTokens(in, out)
+}
+
+func (sp *Joiner) setCache(c *stageCache) {
+	sp.cache = c
+}
+
 func (sp *Joiner) transform(ctx context.Context, text string) (string, error) {
-	ctx, cancelF := context.WithTimeout(ctx, sp.timeout)
-	defer cancelF()
+	res := &response{}
+	if err := postJSON(ctx, sp.httpclient, sp.getURL, sp.timeout, request{Text: text}, res); err != nil {
+		return "", err
+	}
+	return res.Result, nil
+}
 
+// transformTexts implements textsTransformer, with batch enabled all texts go in one call
+func (sp *Joiner) transformTexts(ctx context.Context, texts []string) ([]string, error) {
+	if !sp.batch {
+		res := make([]string, 0, len(texts))
+		for _, text := range texts {
+			r, err := cached(ctx, sp.cache, text, func() (string, error) { return sp.transform(ctx, text) })
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, r)
+		}
+		return res, nil
+	}
+	return cachedBatch(ctx, sp.cache, texts, func(texts []string) ([]string, error) {
+		res := &batchResponse{}
+		if err := postJSON(ctx, sp.httpclient, sp.getURL, sp.timeout, batchRequest{Texts: texts}, res); err != nil {
+			return nil, err
+		}
+		return res.Results, nil
+	})
+}
+
+// postJSON sends in and decodes the response to out
+func postJSON(ctx context.Context, client *http.Client, url string, timeout time.Duration, in, out any) error {
 	b := new(bytes.Buffer)
-	err := json.NewEncoder(b).Encode(request{Text: text})
-	if err != nil {
-		return "", err
+	if err := json.NewEncoder(b).Encode(in); err != nil {
+		return err
 	}
-	req, err := http.NewRequest(http.MethodPost, sp.getURL, b)
+	return callJSON(ctx, client, http.MethodPost, url, nil, b, timeout, out)
+}
+
+// callJSON sends the request and decodes the JSON response to out, body can be nil
+func callJSON(ctx context.Context, client *http.Client, method, url string, headers map[string]string, body io.Reader,
+	timeout time.Duration, out any) error {
+	ctx, cancelF := context.WithTimeout(ctx, timeout)
+	defer cancelF()
+
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
 	if err != nil {
-		return "", err
+		return err
 	}
-	req = req.WithContext(ctx)
-	resp, err := sp.httpclient.Do(req)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
 	if err != nil {
-		return "", err
+		return err
 	}
 	defer func() {
 		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1000))
 		_ = resp.Body.Close()
 	}()
 	if err := goapp.ValidateHTTPResp(resp, 100); err != nil {
-		err = fmt.Errorf("can't invoke '%s': %w", req.URL.String(), err)
-		return "", err
+		return fmt.Errorf("can't invoke '%s': %w", req.URL.String(), err)
 	}
-	res := &response{}
-	err = json.NewDecoder(resp.Body).Decode(&res)
-	if err != nil {
-		return "", err
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("can't decode response: %w", err)
 	}
-	return res.Result, nil
+	return nil
 }
 
 type request struct {
@@ -88,15 +143,32 @@ type response struct {
 	Result string `json:"result"`
 }
 
+type batchResponse struct {
+	Results []string `json:"results"`
+}
+
 func asrHTTPClient() *http.Client {
-	return &http.Client{Transport: newTransport()}
+	return &http.Client{Transport: newTransport(DefaultTransportConfig())}
+}
+
+// TransportConfig configures connections of the HTTP stages
+type TransportConfig struct {
+	MaxConnsPerHost     int           `mapstructure:"maxConnsPerHost"`
+	MaxIdleConns        int           `mapstructure:"maxIdleConns"`
+	MaxIdleConnsPerHost int           `mapstructure:"maxIdleConnsPerHost"`
+	IdleConnTimeout     time.Duration `mapstructure:"idleConnTimeout"`
+}
+
+// DefaultTransportConfig returns the transport settings of the built-in stages
+func DefaultTransportConfig() TransportConfig {
+	return TransportConfig{MaxConnsPerHost: 5, MaxIdleConns: 2, MaxIdleConnsPerHost: 2, IdleConnTimeout: 90 * time.Second}
 }
 
-func newTransport() http.RoundTripper {
+func newTransport(c TransportConfig) http.RoundTripper {
 	res := http.DefaultTransport.(*http.Transport).Clone()
-	res.MaxConnsPerHost = 5
-	res.MaxIdleConns = 2
-	res.MaxIdleConnsPerHost = 2
-	res.IdleConnTimeout = 90 * time.Second
+	res.MaxConnsPerHost = c.MaxConnsPerHost
+	res.MaxIdleConns = c.MaxIdleConns
+	res.MaxIdleConnsPerHost = c.MaxIdleConnsPerHost
+	res.IdleConnTimeout = c.IdleConnTimeout
 	return res
 }
@@ -0,0 +1,248 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/airenas/go-app/pkg/goapp"
+	"github.com/airenas/rt-transcriber-wrapper/internal/api"
+)
+
+// ErrStageFailed is returned by a fail-closed stage, the result must not be sent to the client
+var ErrStageFailed = errors.New("stage failed")
+
+var errBreakerOpen = errors.New("breaker open")
+
+// failure policies
+const (
+	// PolicyOpen skips the failed stage and passes the data further
+	PolicyOpen = "open"
+	// PolicyClosed stops the pipeline with ErrStageFailed
+	PolicyClosed = "closed"
+	// PolicyFallback runs the fallback stage instead
+	PolicyFallback = "fallback"
+)
+
+// Policy configures failure handling of a stage
+type Policy struct {
+	// OnError is one of PolicyOpen (default), PolicyClosed, PolicyFallback
+	OnError string `mapstructure:"onError"`
+	// Fallback stage is used with PolicyFallback
+	Fallback *StageConfig `mapstructure:"fallback"`
+	// Retries after the first failure, with jittered exponential Backoff
+	Retries int           `mapstructure:"retries"`
+	Backoff time.Duration `mapstructure:"backoff"`
+	// BreakerFailures opens the breaker after so many consecutive failures, 0 - no breaker
+	BreakerFailures int `mapstructure:"breakerFailures"`
+	// BreakerCooldown keeps the breaker open before a trial call
+	BreakerCooldown time.Duration `mapstructure:"breakerCooldown"`
+}
+
+func (p *Policy) validate() error {
+	switch p.OnError {
+	case "", PolicyOpen, PolicyClosed:
+	case PolicyFallback:
+		if p.Fallback == nil {
+			return fmt.Errorf("no fallback stage")
+		}
+	default:
+		return fmt.Errorf("unknown policy '%s'", p.OnError)
+	}
+	if p.Retries < 0 || p.BreakerFailures < 0 {
+		return fmt.Errorf("negative retries or breaker failures")
+	}
+	return nil
+}
+
+// guardedStage applies retries, the circuit breaker and the failure policy to a stage
+type guardedStage struct {
+	name     string
+	handler  Handler
+	policy   Policy
+	fallback Handler
+	breaker  *breaker
+}
+
+func (g *guardedStage) Process(ctx context.Context, state *SessionState, data *api.FullResult) (*api.FullResult, error) {
+	res, _, err := g.process(ctx, state, data)
+	return res, err
+}
+
+// process applies the policy, ok tells if the stage itself succeeded
+func (g *guardedStage) process(ctx context.Context, state *SessionState, data *api.FullResult) (*api.FullResult, bool, error) {
+	var res *api.FullResult
+	err := g.guard(ctx, func() error {
+		var err error
+		res, err = g.handler.Process(ctx, state, data)
+		return err
+	})
+	if err == nil {
+		return res, true, nil
+	}
+	switch g.policy.OnError {
+	case PolicyClosed:
+		stageFailures.WithLabelValues(g.name, PolicyClosed).Inc()
+		return nil, false, fmt.Errorf("%s: %w", g.name, ErrStageFailed)
+	case PolicyFallback:
+		stageFailures.WithLabelValues(g.name, PolicyFallback).Inc()
+		res, err := g.fallback.Process(ctx, state, data)
+		return res, false, err
+	}
+	stageFailures.WithLabelValues(g.name, PolicyOpen).Inc()
+	return data, false, nil
+}
+
+// transformTexts implements textsTransformer with the same retries, breaker and policy as the top hypothesis.
+// The fallback stage is used only if it supports alternatives, otherwise they stay unchanged
+func (g *guardedStage) transformTexts(ctx context.Context, texts []string) ([]string, error) {
+	t, ok := g.handler.(textsTransformer)
+	if !ok {
+		return nil, fmt.Errorf("stage does not support nBest")
+	}
+	var res []string
+	err := g.guard(ctx, func() error {
+		var err error
+		res, err = t.transformTexts(ctx, texts)
+		return err
+	})
+	if err == nil {
+		return res, nil
+	}
+	switch g.policy.OnError {
+	case PolicyClosed:
+		stageFailures.WithLabelValues(g.name, PolicyClosed).Inc()
+		return nil, fmt.Errorf("%s: %w", g.name, ErrStageFailed)
+	case PolicyFallback:
+		if ft, ok := g.fallback.(textsTransformer); ok {
+			stageFailures.WithLabelValues(g.name, PolicyFallback).Inc()
+			return ft.transformTexts(ctx, texts)
+		}
+	}
+	stageFailures.WithLabelValues(g.name, PolicyOpen).Inc()
+	return nil, err
+}
+
+// guard calls f with retries if the breaker allows
+func (g *guardedStage) guard(ctx context.Context, f func() error) error {
+	if g.breaker != nil && !g.breaker.allow() {
+		goapp.Log.Debug().Str("stage", g.name).Msg("breaker open, bypass")
+		return errBreakerOpen
+	}
+	err := g.try(ctx, f)
+	if g.breaker != nil {
+		g.breaker.done(err == nil)
+	}
+	if err != nil {
+		goapp.Log.Warn().Err(err).Str("stage", g.name).Msg("stage failed")
+	}
+	return err
+}
+
+func (g *guardedStage) try(ctx context.Context, f func() error) error {
+	for i := 0; ; i++ {
+		err := f()
+		if err == nil || i >= g.policy.Retries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff(g.policy.Backoff, i)):
+		}
+	}
+}
+
+// backoff returns base*2^try with +-50% jitter
+func backoff(base time.Duration, try int) time.Duration {
+	if base <= 0 {
+		base = 50 * time.Millisecond
+	}
+	d := base << min(try, 10)
+	return d/2 + rand.N(d)
+}
+
+type breakerStateType int
+
+const (
+	breakerClosed breakerStateType = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+func (s breakerStateType) String() string {
+	return [...]string{"closed", "half-open", "open"}[s]
+}
+
+// breaker opens after consecutive failures and lets one trial call through after the cooldown
+type breaker struct {
+	name     string
+	failures int
+	cooldown time.Duration
+	now      func() time.Time
+
+	lock     sync.Mutex
+	state    breakerStateType
+	failed   int
+	openedAt time.Time
+	trial    bool
+}
+
+func newBreaker(name string, failures int, cooldown time.Duration) *breaker {
+	if cooldown <= 0 {
+		cooldown = 30 * time.Second
+	}
+	res := &breaker{name: name, failures: failures, cooldown: cooldown, now: time.Now}
+	breakerState.WithLabelValues(name).Set(float64(breakerClosed))
+	return res
+}
+
+func (b *breaker) allow() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.set(breakerHalfOpen)
+		b.trial = true
+		return true
+	case breakerHalfOpen:
+		if b.trial {
+			return false // one trial call at a time
+		}
+		b.trial = true
+		return true
+	}
+	return true
+}
+
+func (b *breaker) done(ok bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.trial = false
+	if ok {
+		b.failed = 0
+		b.set(breakerClosed)
+		return
+	}
+	b.failed++
+	if b.state == breakerHalfOpen || b.failed >= b.failures {
+		b.openedAt = b.now()
+		b.set(breakerOpen)
+	}
+}
+
+func (b *breaker) set(s breakerStateType) {
+	if b.state == s {
+		return
+	}
+	goapp.Log.Info().Str("stage", b.name).Str("from", b.state.String()).Str("to", s.String()).Msg("breaker")
+	b.state = s
+	breakerState.WithLabelValues(b.name).Set(float64(s))
+	breakerChanges.WithLabelValues(b.name, s.String()).Inc()
+}
@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/airenas/rt-transcriber-wrapper/internal/api"
+)
+
+type failingStage struct {
+	calls int
+	fails int
+}
+
+func (s *failingStage) Process(_ context.Context, _ *SessionState, data *api.FullResult) (*api.FullResult, error) {
+	s.calls++
+	if s.calls <= s.fails {
+		return nil, errors.New("fail")
+	}
+	return data, nil
+}
+
+func TestBreaker(t *testing.T) {
+	now := time.Now()
+	b := newBreaker("test", 2, time.Second)
+	b.now = func() time.Time { return now }
+	b.done(false)
+	if !b.allow() {
+		t.Fatal("allow() = false after one failure")
+	}
+	b.done(false)
+	if b.allow() {
+		t.Fatal("allow() = true for open breaker")
+	}
+	now = now.Add(2 * time.Second)
+	if !b.allow() {
+		t.Fatal("allow() = false after cooldown")
+	}
+	if b.allow() {
+		t.Fatal("allow() = true for second trial")
+	}
+	b.done(true)
+	if !b.allow() || b.state != breakerClosed {
+		t.Fatal("breaker not closed after successful trial")
+	}
+}
+
+func TestGuardedStage_Process(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    Policy
+		fails     int
+		wantErr   error
+		wantCalls int
+	}{
+		{name: "open", policy: Policy{OnError: PolicyOpen}, fails: 1, wantCalls: 1},
+		{name: "closed", policy: Policy{OnError: PolicyClosed}, fails: 1, wantErr: ErrStageFailed, wantCalls: 1},
+		{name: "retry", policy: Policy{OnError: PolicyClosed, Retries: 2, Backoff: time.Millisecond}, fails: 2, wantCalls: 3},
+		{name: "retries exhausted", policy: Policy{OnError: PolicyClosed, Retries: 1, Backoff: time.Millisecond}, fails: 2,
+			wantErr: ErrStageFailed, wantCalls: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &failingStage{fails: tt.fails}
+			g := &guardedStage{name: "test", handler: s, policy: tt.policy}
+			_, err := g.Process(context.Background(), NewSessionState(), &api.FullResult{})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Process() err = %v, want %v", err, tt.wantErr)
+			}
+			if s.calls != tt.wantCalls {
+				t.Errorf("Process() calls = %d, want %d", s.calls, tt.wantCalls)
+			}
+		})
+	}
+}
@@ -0,0 +1,270 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/airenas/go-app/pkg/goapp"
+	"github.com/airenas/rt-transcriber-wrapper/internal/api"
+	"github.com/airenas/rt-transcriber-wrapper/internal/utils"
+)
+
+// ProcessStageConfig configures an external process stage
+type ProcessStageConfig struct {
+	Name string `mapstructure:"-"`
+	// Timeout limits one message, the process is restarted after it
+	Timeout time.Duration `mapstructure:"-"`
+	Command string        `mapstructure:"command"`
+	Args    []string      `mapstructure:"args"`
+	Dir     string        `mapstructure:"dir"`
+	// Env adds KEY=value variables to the environment of the service
+	Env []string `mapstructure:"env"`
+	// Pool is the number of processes, 1 by default
+	Pool int `mapstructure:"pool"`
+}
+
+// ProcessStage exchanges results with an executable as JSON lines over stdin and stdout:
+// one api.FullResult line in, one line out. A crashed, timed out or out of sync process is restarted
+// on the next message
+type ProcessStage struct {
+	cfg     ProcessStageConfig
+	timeout time.Duration
+	// workers keeps idle processes, nil is a slot of a process to start
+	workers chan *procWorker
+
+	lock sync.Mutex
+	// running are all started processes, idle or busy
+	running map[*procWorker]bool
+	closed  bool
+}
+
+// NewProcessStage starts the processes of the stage
+func NewProcessStage(cfg ProcessStageConfig) (*ProcessStage, error) {
+	if cfg.Command == "" {
+		return nil, fmt.Errorf("no command")
+	}
+	if cfg.Pool < 0 {
+		return nil, fmt.Errorf("wrong pool %d", cfg.Pool)
+	}
+	if cfg.Pool == 0 {
+		cfg.Pool = 1
+	}
+	res := &ProcessStage{cfg: cfg, timeout: time.Second * 5, workers: make(chan *procWorker, cfg.Pool),
+		running: map[*procWorker]bool{}}
+	if cfg.Timeout > 0 {
+		res.timeout = cfg.Timeout
+	}
+	for i := 0; i < cfg.Pool; i++ {
+		w, err := res.start()
+		if err != nil {
+			_ = res.Close()
+			return nil, err
+		}
+		res.workers <- w
+	}
+	goapp.Log.Info().Str("name", cfg.Name).Str("command", cfg.Command).Strs("args", cfg.Args).Int("pool", cfg.Pool).
+		Dur("timeout", res.timeout).Msg("Process stage")
+	return res, nil
+}
+
+func (sp *ProcessStage) Process(ctx context.Context, state *SessionState, data *api.FullResult) (*api.FullResult, error) {
+	defer utils.MeasureTime(sp.cfg.Name, time.Now())
+	ctx, cancelF := context.WithTimeout(ctx, sp.timeout)
+	defer cancelF()
+
+	in, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	var w *procWorker
+	select {
+	case w = <-sp.workers:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("no free process: %w", ctx.Err())
+	}
+	if w != nil && w.stale() {
+		goapp.Log.Warn().Str("stage", sp.cfg.Name).Msg("idle process exited or wrote unexpected output, restarting")
+		sp.kill(w)
+		w = nil
+	}
+	if w == nil {
+		processRestarts.WithLabelValues(sp.cfg.Name).Inc()
+		if w, err = sp.start(); err != nil {
+			sp.workers <- nil
+			return nil, err
+		}
+	}
+	res := &api.FullResult{}
+	out, err := w.call(ctx, in)
+	if err == nil {
+		if err = json.Unmarshal(out, res); err != nil {
+			err = fmt.Errorf("wrong process output: %w", err)
+		}
+	}
+	if err != nil {
+		// the next output line may belong to this message, so the process can't be reused
+		sp.kill(w)
+		sp.workers <- nil
+		return nil, fmt.Errorf("process '%s': %w", sp.cfg.Command, err)
+	}
+	sp.workers <- w
+	return res, nil
+}
+
+// Close stops all processes, busy ones too, later messages fail
+func (sp *ProcessStage) Close() error {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	sp.closed = true
+	for w := range sp.running {
+		w.kill()
+	}
+	clear(sp.running)
+	return nil
+}
+
+func (sp *ProcessStage) start() (*procWorker, error) {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	if sp.closed {
+		return nil, fmt.Errorf("stage closed")
+	}
+	w, err := startWorker(&sp.cfg)
+	if err != nil {
+		return nil, err
+	}
+	sp.running[w] = true
+	return w, nil
+}
+
+func (sp *ProcessStage) kill(w *procWorker) {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	if sp.running[w] {
+		delete(sp.running, w)
+		w.kill()
+	}
+}
+
+type procWorker struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.Closer
+	// lines are the output lines, closed when the process exits
+	lines chan []byte
+	// killed is closed by kill, child processes may keep the output open after that
+	killed   chan struct{}
+	killOnce sync.Once
+}
+
+func startWorker(cfg *ProcessStageConfig) (*procWorker, error) {
+	cmd := exec.Command(cfg.Command, cfg.Args...)
+	cmd.Dir = cfg.Dir
+	cmd.Env = append(os.Environ(), cfg.Env...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("can't start '%s': %w", cfg.Command, err)
+	}
+	res := &procWorker{cmd: cmd, stdin: stdin, stdout: stdout, lines: make(chan []byte, 1), killed: make(chan struct{})}
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		r := bufio.NewReaderSize(stdout, 64*1024)
+		for {
+			line, err := r.ReadBytes('\n')
+			if len(line) > 0 {
+				res.lines <- line
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		s := bufio.NewScanner(stderr)
+		for s.Scan() {
+			goapp.Log.Warn().Str("stage", cfg.Name).Str("stderr", s.Text()).Send()
+		}
+	}()
+	go func() {
+		wg.Wait()
+		err := cmd.Wait()
+		goapp.Log.Info().Err(err).Str("stage", cfg.Name).Int("pid", cmd.Process.Pid).Msg("process exited")
+		close(res.lines)
+	}()
+	return res, nil
+}
+
+// call writes the message and waits for one output line, both bounded by ctx
+func (w *procWorker) call(ctx context.Context, msg []byte) ([]byte, error) {
+	written := make(chan error, 1)
+	go func() {
+		_, err := w.stdin.Write(append(msg, '\n'))
+		written <- err
+	}()
+	select {
+	case err := <-written:
+		if err != nil {
+			return nil, fmt.Errorf("can't write: %w", err)
+		}
+	case <-w.killed:
+		return nil, fmt.Errorf("process killed")
+	case <-ctx.Done():
+		return nil, fmt.Errorf("can't write: %w", ctx.Err())
+	}
+	select {
+	case line, ok := <-w.lines:
+		if !ok {
+			return nil, fmt.Errorf("process exited")
+		}
+		return line, nil
+	case <-w.killed:
+		return nil, fmt.Errorf("process killed")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// stale tells if the idle process has written something not requested
+func (w *procWorker) stale() bool {
+	select {
+	case <-w.lines:
+		return true
+	default:
+		return false
+	}
+}
+
+// kill stops the process, the blocked writes and reads end with it
+func (w *procWorker) kill() {
+	w.killOnce.Do(func() {
+		close(w.killed)
+		_ = w.stdin.Close()
+		_ = w.stdout.Close()
+		_ = w.cmd.Process.Kill()
+		go func() {
+			for range w.lines {
+			}
+		}()
+	})
+}
@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/airenas/rt-transcriber-wrapper/internal/api"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestProcessStage(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh")
+	}
+	tests := []struct {
+		name     string
+		script   string
+		pause    time.Duration
+		wantErrs []bool
+	}{
+		{name: "echo", script: "cat", wantErrs: []bool{false, false}},
+		{name: "timeout", script: "sleep 10", wantErrs: []bool{true, true}},
+		{name: "wrong output", script: "while read l; do echo wrong; echo \"$l\"; done", wantErrs: []bool{true, true}},
+		{name: "extra output", script: "while read l; do echo \"$l\"; echo \"$l\"; done", pause: 100 * time.Millisecond,
+			wantErrs: []bool{false, false, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sp, err := NewProcessStage(ProcessStageConfig{Name: tt.name, Command: "sh", Args: []string{"-c", tt.script},
+				Timeout: 200 * time.Millisecond, Pool: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sp.Close()
+			for i, wantErr := range tt.wantErrs {
+				time.Sleep(tt.pause)
+				in := &api.FullResult{Segment: i, Result: api.Result{Hypotheses: []api.Hypothesis{{Transcript: "a"}}}}
+				got, err := sp.Process(context.Background(), NewSessionState(), in)
+				if (err != nil) != wantErr {
+					t.Fatalf("Process() %d err = %v, wantErr %v", i, err, wantErr)
+				}
+				if err == nil && (got.Segment != i || got.Result.Hypotheses[0].Transcript != "a") {
+					t.Errorf("Process() %d = %v", i, got)
+				}
+			}
+		})
+	}
+}
+
+func TestProcessStage_restart(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh")
+	}
+	sp, err := NewProcessStage(ProcessStageConfig{Name: "restart", Command: "sh", Args: []string{"-c", "read l; echo \"$l\""},
+		Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sp.Close()
+	restarts := testutil.ToFloat64(processRestarts.WithLabelValues("restart"))
+	for i := range 2 {
+		in := &api.FullResult{Segment: i, Result: api.Result{Hypotheses: []api.Hypothesis{{Transcript: "a"}}}}
+		got, err := sp.Process(context.Background(), NewSessionState(), in)
+		if err != nil {
+			t.Fatalf("Process() %d err = %v", i, err)
+		}
+		if got.Segment != i {
+			t.Errorf("Process() %d = %v", i, got)
+		}
+		// wait for the process to exit after the reply
+		w := <-sp.workers
+		for range w.lines {
+		}
+		sp.workers <- w
+	}
+	if got := testutil.ToFloat64(processRestarts.WithLabelValues("restart")) - restarts; got != 1 {
+		t.Errorf("restarts = %v, want 1", got)
+	}
+}
+
+func TestNewProcessStage_fails(t *testing.T) {
+	if _, err := NewProcessStage(ProcessStageConfig{}); err == nil {
+		t.Errorf("NewProcessStage() no error for empty command")
+	}
+	if _, err := NewProcessStage(ProcessStageConfig{Command: "/no/such/command"}); err == nil {
+		t.Errorf("NewProcessStage() no error for missing command")
+	}
+}
+
+func TestProcessStage_blocked(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh")
+	}
+	r := NewRegistry()
+	h, err := r.Build([]*StageConfig{{Name: "sleep", Type: "process", Timeout: 200 * time.Millisecond, Policy: Policy{OnError: PolicyClosed},
+		Settings: map[string]any{"command": "sh", "args": []string{"-c", "sleep 10"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	// bigger than the pipe buffer, the write blocks as the process does not read
+	in := &api.FullResult{Result: api.Result{Hypotheses: []api.Hypothesis{{Transcript: strings.Repeat("a", 1<<20)}}}}
+	start := time.Now()
+	if _, err := h.Process(context.Background(), NewSessionState(), in); err == nil {
+		t.Errorf("Process() no error for blocked write")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Process() took %v", d)
+	}
+}
+
+func TestProcessStage_Close(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh")
+	}
+	r := NewRegistry()
+	h, err := r.Build([]*StageConfig{{Name: "sleep", Type: "process", Timeout: 10 * time.Second, Policy: Policy{OnError: PolicyClosed},
+		Settings: map[string]any{"command": "sh", "args": []string{"-c", "sleep 10"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		_ = r.Close()
+	}()
+	start := time.Now()
+	if _, err := h.Process(context.Background(), NewSessionState(), &api.FullResult{}); err == nil {
+		t.Errorf("Process() no error for closed stage")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Process() took %v, busy process not killed", d)
+	}
+	if _, err := h.Process(context.Background(), NewSessionState(), &api.FullResult{}); err == nil {
+		t.Errorf("Process() no error after Close")
+	}
+}
@@ -1,15 +1,13 @@
 package handlers
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
 	"strings"
 	"time"
 	"unicode"
+	"unicode/utf8"
 
 	"github.com/airenas/go-app/pkg/goapp"
 	"github.com/airenas/rt-transcriber-wrapper/internal/api"
@@ -21,6 +19,46 @@ type Punctuator struct {
 	httpclient *http.Client
 	getURL     string
 	timeout    time.Duration
+	cache      *stageCache
+	context    PunctuatorContext
+	// batch sends alternatives in one call
+	batch bool
+}
+
+// PunctuatorContext configures how much history is sent to the punctuator with a new segment
+type PunctuatorContext struct {
+	// MinWords of previous final segments are always sent, older words are added until a sentence end
+	MinWords int `mapstructure:"minWords"`
+	// MaxWords limits the context, older segments are evicted from the session memory
+	MaxWords int `mapstructure:"maxWords"`
+	// SentenceEnd lists the characters ending a sentence
+	SentenceEnd string `mapstructure:"sentenceEnd"`
+	// KeepFinals disables re-punctuation of previous final segments, they are sent as context only
+	KeepFinals bool `mapstructure:"keepFinals"`
+	// UpdateInterval limits how often corrections of previous segments are sent,
+	// postponed ones are merged and sent later, at the latest with the final result
+	UpdateInterval time.Duration `mapstructure:"updateInterval"`
+}
+
+// DefaultPunctuatorContext returns the default context settings
+func DefaultPunctuatorContext() PunctuatorContext {
+	return PunctuatorContext{MinWords: 16, MaxWords: 100, SentenceEnd: ".?!"}
+}
+
+func (c *PunctuatorContext) validate() error {
+	if c.MinWords < 0 {
+		return fmt.Errorf("wrong minWords %d", c.MinWords)
+	}
+	if c.MaxWords <= 0 || c.MaxWords < c.MinWords {
+		return fmt.Errorf("wrong maxWords %d, must be positive and not less than minWords", c.MaxWords)
+	}
+	if c.SentenceEnd == "" {
+		return fmt.Errorf("no sentenceEnd")
+	}
+	if c.UpdateInterval < 0 {
+		return fmt.Errorf("wrong updateInterval %v", c.UpdateInterval)
+	}
+	return nil
 }
 
 // Punctuator
@@ -33,26 +71,43 @@ type punctData struct {
 	text        string
 	fromSegment int
 	fromWord    int
+	context     *PunctuatorContext
 }
 
-// NewPunctuator creates a punctuation middleware
-func NewPunctuator(getURL string) (*Punctuator, error) {
+// NewPunctuator creates a punctuation middleware, batch enables {"texts": [...]} -> {"results": [...]} calls for alternatives
+func NewPunctuator(getURL string, timeout time.Duration, batch bool) (*Punctuator, error) {
 	res := Punctuator{}
 	if getURL == "" {
 		return nil, fmt.Errorf("no getURL")
 	}
 	res.getURL = getURL
+	res.batch = batch
 	res.timeout = time.Second * 10
+	res.context = DefaultPunctuatorContext()
+	if timeout > 0 {
+		res.timeout = timeout
+	}
 	res.httpclient = asrHTTPClient()
-	goapp.Log.Info().Str("url", getURL).Msg("Punctuator")
+	goapp.Log.Info().Str("url", getURL).Dur("timeout", res.timeout).Msg("Punctuator")
 	return &res, nil
 }
 
-func (sp *Punctuator) Process(ctx context.Context, data *api.FullResult) (*api.FullResult, error) {
+// SetContext changes the context settings
+func (sp *Punctuator) SetContext(c PunctuatorContext) error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+	sp.context = c
+	goapp.Log.Info().Int("minWords", c.MinWords).Int("maxWords", c.MaxWords).Str("sentenceEnd", c.SentenceEnd).
+		Bool("keepFinals", c.KeepFinals).Dur("updateInterval", c.UpdateInterval).Msg("Punctuator context")
+	return nil
+}
+
+func (sp *Punctuator) Process(ctx context.Context, state *SessionState, data *api.FullResult) (*api.FullResult, error) {
 	defer utils.MeasureTime("punctuator", time.Now())
 	if len(data.Result.Hypotheses) > 0 {
-		ctx, ctxData := utils.CustomContext(ctx)
-		punctData := &punctData{ctxData: ctxData}
+		memory := state.Value(sp, func() any { return newSegmentMemory() }).(*segmentMemory)
+		punctData := &punctData{ctxData: &memory.CustomData, context: &sp.context}
 		punctData.original = strings.TrimSpace(data.Result.Hypotheses[0].Transcript)
 		punctData.segment = data.Segment
 		punctData.final = data.Result.Final
@@ -62,16 +117,19 @@ func (sp *Punctuator) Process(ctx context.Context, data *api.FullResult) (*api.F
 			if err != nil {
 				return nil, err
 			}
-			original, punctuated, err := sp.transform(ctx, punctData.text)
+			res, err := cached(ctx, sp.cache, punctData.text, func() (*punctResponse, error) {
+				return sp.transform(ctx, punctData.text)
+			})
 			if err != nil {
 				return nil, err
 			}
-			newText, segments, err := fillPuntResult(punctData, original, punctuated)
+			newText, segments, err := fillPuntResult(punctData, res.Original, res.Punctuated)
 			if err != nil {
 				return nil, err
 			}
 			data.Result.Hypotheses[0].Transcript = newText
-			data.OldUpdates = segments
+			data.OldUpdates = memory.updates(segments, punctData.final, sp.context.UpdateInterval)
+			memory.shrink(sp.context.MaxWords)
 		}
 	}
 	return data, nil
@@ -104,7 +162,7 @@ func fillPuntResult(punctData *punctData, original []string, punctuated []string
 			} else {
 				segment.Processed[iW].Original = original[i]
 			}
-			if segment.Processed[iW].Punctuated != punctuated[i] {
+			if segment.Processed[iW].Punctuated != punctuated[i] && !punctData.keep(segment) {
 				segment.Processed[iW].Punctuated = punctuated[i]
 				if segment.ID != punctData.segment {
 					changes[segment.ID] = true
@@ -114,6 +172,12 @@ func fillPuntResult(punctData *punctData, original []string, punctuated []string
 		iW++
 		i++
 	}
+	// a shorter hypothesis of the current segment drops the words left from the previous one
+	if iS < len(ctxData.Segments) {
+		if segment := ctxData.Segments[iS]; !segment.Final && iW < len(segment.Processed) {
+			segment.Processed = segment.Processed[:iW]
+		}
+	}
 	res := ""
 	if len(ctxData.Segments) > 0 {
 		ctxData.Segments[len(ctxData.Segments)-1].Final = punctData.final
@@ -126,13 +190,18 @@ func fillPuntResult(punctData *punctData, original []string, punctuated []string
 			if changes[segment.ID] {
 				resOldChanges = append(resOldChanges, &api.ShortResult{Segment: segment.ID,
 					Transcript: getSegmentText(segment), Final: segment.Final})
-				goapp.Log.Debug().Int("segment", segment.ID).Msg("changed")	
+				goapp.Log.Debug().Int("segment", segment.ID).Msg("changed")
 			}
 		}
 	}
 	return res, resOldChanges, nil
 }
 
+// keep tells if the punctuation of the segment must not change
+func (pd *punctData) keep(segment *utils.Segments) bool {
+	return pd.context.KeepFinals && segment.Final && segment.ID != pd.segment
+}
+
 func getSegmentText(segments *utils.Segments) string {
 	res := strings.Builder{}
 	for _, p := range segments.Processed {
@@ -146,6 +215,7 @@ func getSegmentText(segments *utils.Segments) string {
 
 func fillPunctData(punctData *punctData) error {
 	segments := punctData.ctxData.Segments
+	c := punctData.context
 	punctData.fromSegment = 0
 	punctData.fromWord = 0
 	nextWord, nextSegmentIndex, nextWordIndex := "", 0, 0
@@ -158,7 +228,10 @@ mainLoop:
 		}
 		for j := len(segment.Processed) - 1; j >= 0; j-- {
 			pData := segment.Processed[j]
-			if len(words) > 15 && isUpperOrNumber(nextWord) && sentenceEnd(pData.Punctuated) {
+			if len(words) >= c.MaxWords {
+				break mainLoop
+			}
+			if len(words) >= c.MinWords && isUpperOrNumber(nextWord) && sentenceEnd(pData.Punctuated, c.SentenceEnd) {
 				goapp.Log.Debug().Str("word", nextWord).Str("punct", pData.Punctuated).Msg("sentence end")
 				break mainLoop
 			}
@@ -191,52 +264,70 @@ func isUpperOrNumber(word string) bool {
 	if len(word) == 0 {
 		return false
 	}
-	firstRune := rune(word[0])
+	firstRune, _ := utf8.DecodeRuneInString(word)
 	return unicode.IsUpper(firstRune) || unicode.IsDigit(firstRune)
 }
 
-func sentenceEnd(word string) bool {
+func sentenceEnd(word string, chars string) bool {
 	if len(word) == 0 {
 		return false
 	}
-	lastChar := word[len(word)-1]
-	return lastChar == '.' || lastChar == '?' || lastChar == '!'
+	lastChar, _ := utf8.DecodeLastRuneInString(word)
+	return strings.ContainsRune(chars, lastChar)
 }
 
-func (sp *Punctuator) transform(ctx context.Context, text string) ([]string, []string, error) {
-	goapp.Log.Debug().Str("text", text).Msg("punctuating")
-	ctx, cancelF := context.WithTimeout(ctx, sp.timeout)
-	defer cancelF()
+// mapTokens implements tokenMapper, punctuation keeps the words one to one
+func (sp *Punctuator) mapTokens(in, out []string) TokenMap {
+	if len(in) != len(out) {
+		return alignTokens(in, out)
+	}
+	return identityMap(len(in))
+}
 
-	b := new(bytes.Buffer)
-	err := json.NewEncoder(b).Encode(punctRequest{Text: text})
-	if err != nil {
-		return nil, nil, err
+func (sp *Punctuator) setCache(c *stageCache) {
+	sp.cache = c
+}
+
+func (sp *Punctuator) transform(ctx context.Context, text string) (*punctResponse, error) {
+	goapp.Log.Debug().Str("text", text).Msg("punctuating")
+	res := &punctResponse{}
+	if err := postJSON(ctx, sp.httpclient, sp.getURL, sp.timeout, punctRequest{Text: text}, res); err != nil {
+		return nil, err
 	}
-	req, err := http.NewRequest(http.MethodPost, sp.getURL, b)
-	if err != nil {
-		return nil, nil, err
+	goapp.Log.Debug().Str("text", res.PunctuatedText).Msg("punctuation result")
+	return res, nil
+}
+
+// transformTexts implements textsTransformer, the alternatives are punctuated without the segment context
+func (sp *Punctuator) transformTexts(ctx context.Context, texts []string) ([]string, error) {
+	var results []*punctResponse
+	var err error
+	if sp.batch {
+		results, err = cachedBatch(ctx, sp.cache, texts, func(texts []string) ([]*punctResponse, error) {
+			res := &punctBatchResponse{}
+			if err := postJSON(ctx, sp.httpclient, sp.getURL, sp.timeout, batchRequest{Texts: texts}, res); err != nil {
+				return nil, err
+			}
+			return res.Results, nil
+		})
+	} else {
+		for _, text := range texts {
+			var r *punctResponse
+			r, err = cached(ctx, sp.cache, text, func() (*punctResponse, error) { return sp.transform(ctx, text) })
+			if err != nil {
+				break
+			}
+			results = append(results, r)
+		}
 	}
-	req = req.WithContext(ctx)
-	resp, err := sp.httpclient.Do(req)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	defer func() {
-		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1000))
-		_ = resp.Body.Close()
-	}()
-	if err := goapp.ValidateHTTPResp(resp, 100); err != nil {
-		err = fmt.Errorf("can't invoke '%s': %w", req.URL.String(), err)
-		return nil, nil, err
+	res := make([]string, 0, len(results))
+	for _, r := range results {
+		res = append(res, strings.Join(r.Punctuated, " "))
 	}
-	res := &punctResponse{}
-	err = json.NewDecoder(resp.Body).Decode(&res)
-	if err != nil {
-		return nil, nil, err
-	}
-	goapp.Log.Debug().Str("text", res.PunctuatedText).Msg("punctuation result")
-	return res.Original, res.Punctuated, nil
+	return res, nil
 }
 
 type punctRequest struct {
@@ -248,3 +339,7 @@ type punctResponse struct {
 	Original       []string `json:"original"`
 	Punctuated     []string `json:"punctuated"`
 }
+
+type punctBatchResponse struct {
+	Results []*punctResponse `json:"results"`
+}
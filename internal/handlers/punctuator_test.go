@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/airenas/rt-transcriber-wrapper/internal/utils"
+)
+
+func TestFillPunctData(t *testing.T) {
+	segments := []*utils.Segments{testSegment(1, true, "a", "b."), testSegment(2, true, "Cc", "d!"), testSegment(3, true, "Ee", "f")}
+	tests := []struct {
+		name     string
+		context  PunctuatorContext
+		want     string
+		wantFrom [2]int
+	}{
+		{name: "sentence", context: PunctuatorContext{MinWords: 1, MaxWords: 10, SentenceEnd: ".!"}, want: "Ee f g", wantFrom: [2]int{2, 0}},
+		{name: "min words", context: PunctuatorContext{MinWords: 3, MaxWords: 10, SentenceEnd: ".!"}, want: "Cc d! Ee f g", wantFrom: [2]int{1, 0}},
+		{name: "end chars", context: PunctuatorContext{MinWords: 1, MaxWords: 10, SentenceEnd: "."}, want: "Cc d! Ee f g", wantFrom: [2]int{1, 0}},
+		{name: "max words", context: PunctuatorContext{MinWords: 5, MaxWords: 5, SentenceEnd: "."}, want: "b. Cc d! Ee f g", wantFrom: [2]int{0, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := &punctData{ctxData: &utils.CustomData{Segments: segments}, original: "g", context: &tt.context}
+			if err := fillPunctData(data); err != nil {
+				t.Fatal(err)
+			}
+			if data.text != tt.want || data.fromSegment != tt.wantFrom[0] || data.fromWord != tt.wantFrom[1] {
+				t.Errorf("fillPunctData() = %q from %d:%d, want %q from %v", data.text, data.fromSegment, data.fromWord, tt.want, tt.wantFrom)
+			}
+		})
+	}
+}
+
+func TestIsUpperOrNumber(t *testing.T) {
+	tests := []struct {
+		word string
+		want bool
+	}{
+		{word: "Labas", want: true},
+		{word: "Šiandien", want: true},
+		{word: "Žmonės", want: true},
+		{word: "1990", want: true},
+		{word: "šiandien"},
+		{word: "labas"},
+		{word: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.word, func(t *testing.T) {
+			if got := isUpperOrNumber(tt.word); got != tt.want {
+				t.Errorf("isUpperOrNumber() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFillPuntResult_keepFinals(t *testing.T) {
+	tests := []struct {
+		name       string
+		keepFinals bool
+		wantOld    string
+		wantUpdate bool
+	}{
+		{name: "repunctuate", wantOld: "a.", wantUpdate: true},
+		{name: "keep", keepFinals: true, wantOld: "a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := &punctData{ctxData: &utils.CustomData{Segments: []*utils.Segments{testSegment(1, true, "a")}},
+				segment: 2, original: "b", context: &PunctuatorContext{KeepFinals: tt.keepFinals}}
+			text, updates, err := fillPuntResult(data, []string{"a", "b"}, []string{"a.", "B"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if text != "B" {
+				t.Errorf("fillPuntResult() = %q, want %q", text, "B")
+			}
+			if got := data.ctxData.Segments[0].Processed[0].Punctuated; got != tt.wantOld {
+				t.Errorf("fillPuntResult() old = %q, want %q", got, tt.wantOld)
+			}
+			if (len(updates) > 0) != tt.wantUpdate {
+				t.Errorf("fillPuntResult() updates = %v, want %v", updates, tt.wantUpdate)
+			}
+		})
+	}
+}
+
+func TestFillPuntResult_shorterFinal(t *testing.T) {
+	ctxData := &utils.CustomData{}
+	context := DefaultPunctuatorContext()
+	steps := []struct {
+		original string
+		final    bool
+		want     string
+	}{
+		{original: "a b c d", want: "A b c d"},
+		{original: "a b", final: true, want: "A b."},
+	}
+	for _, s := range steps {
+		data := &punctData{ctxData: ctxData, segment: 1, original: s.original, final: s.final, context: &context}
+		if err := fillPunctData(data); err != nil {
+			t.Fatal(err)
+		}
+		words := strings.Fields(data.text)
+		punctuated := slices.Clone(words)
+		punctuated[0] = strings.ToUpper(punctuated[0])
+		if s.final {
+			punctuated[len(punctuated)-1] += "."
+		}
+		text, _, err := fillPuntResult(data, words, punctuated)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if text != s.want {
+			t.Errorf("fillPuntResult(%q) = %q, want %q", s.original, text, s.want)
+		}
+	}
+	if got := len(ctxData.Segments[0].Processed); got != 2 {
+		t.Errorf("fillPuntResult() kept %d words, want 2", got)
+	}
+}
+
+func TestRegistry_punctuatorSettings(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings map[string]any
+		wantErr  bool
+	}{
+		{name: "default"},
+		{name: "context", settings: map[string]any{"context": map[string]any{"minwords": 5, "maxwords": "50", "updateinterval": "1s"}}},
+		{name: "unknown", settings: map[string]any{"contex": map[string]any{}}, wantErr: true},
+		{name: "wrong", settings: map[string]any{"context": map[string]any{"minwords": 50, "maxwords": 5}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewRegistry().Build([]*StageConfig{{Name: "punctuator", URL: "http://p", Settings: tt.settings}})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Build() err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,266 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/airenas/go-app/pkg/goapp"
+	"github.com/airenas/rt-transcriber-wrapper/internal/domain"
+	"github.com/airenas/rt-transcriber-wrapper/internal/secure"
+	"github.com/redis/go-redis/v9"
+)
+
+// StageConfig describes one pipeline stage
+type StageConfig struct {
+	// Name identifies the stage in logs, must be unique in the pipeline
+	Name string `mapstructure:"name"`
+	// Type selects the factory in the registry, defaults to Name
+	Type    string        `mapstructure:"type"`
+	URL     string        `mapstructure:"url"`
+	Timeout time.Duration `mapstructure:"timeout"`
+	// Partials enables the stage for partial results, nil means enabled
+	Partials *bool `mapstructure:"partials"`
+	// Async sends the result of previous stages at once, this and later stages run in background
+	// and their result is delivered as corrections of the segment
+	Async bool        `mapstructure:"async"`
+	Cache CacheConfig `mapstructure:"cache"`
+	// NBest is the number of hypotheses the stage processes, 0 or 1 - the top one only, -1 - all.
+	// Alternatives are processed without the session state
+	NBest int `mapstructure:"nBest"`
+	// Policy handles failures of the stage
+	Policy `mapstructure:",squash"`
+	// Settings keeps other stage specific settings
+	Settings map[string]any `mapstructure:",remain"`
+}
+
+// ForPartials tells if the stage processes partial results
+func (c *StageConfig) ForPartials() bool {
+	return c.Partials == nil || *c.Partials
+}
+
+// StageFactory creates a handler from the stage config
+type StageFactory func(cfg *StageConfig) (Handler, error)
+
+// Registry keeps stage factories by type
+type Registry struct {
+	// PartialInterval is set to all built pipelines, see ListHandler.SetPartialInterval
+	PartialInterval time.Duration
+	// CacheClient and CacheCrypter enable shared stage caches
+	CacheClient  redis.UniversalClient
+	CacheCrypter *secure.Crypter
+	// Dictionaries provides user rules for the dictionary stages
+	Dictionaries DictionaryGetter
+	// Configs provides user configs for the mask stages
+	Configs UserConfigGetter
+
+	factories map[string]StageFactory
+	// breakers are shared by stage name, so profiles using the same stage see the same endpoint state
+	breakers map[string]*breaker
+	// caches are shared by stage name
+	caches map[string]*stageCache
+	// closers are the built stages holding resources, see Close
+	closers []io.Closer
+}
+
+// NewRegistry creates a registry with the built-in stages: cleaner, joiner, punctuator, http, process, dictionary and mask
+func NewRegistry() *Registry {
+	res := &Registry{factories: map[string]StageFactory{}, breakers: map[string]*breaker{}, caches: map[string]*stageCache{}}
+	res.Register("cleaner", func(cfg *StageConfig) (Handler, error) {
+		return NewCleaner()
+	})
+	res.Register("joiner", func(cfg *StageConfig) (Handler, error) {
+		settings := struct {
+			Batch bool `mapstructure:"batch"`
+		}{}
+		if err := decodeSettings(cfg, &settings); err != nil {
+			return nil, err
+		}
+		return NewJoiner(cfg.URL, cfg.Timeout, settings.Batch)
+	})
+	res.Register("punctuator", func(cfg *StageConfig) (Handler, error) {
+		settings := struct {
+			Context PunctuatorContext `mapstructure:"context"`
+			Batch   bool              `mapstructure:"batch"`
+		}{Context: DefaultPunctuatorContext()}
+		if err := decodeSettings(cfg, &settings); err != nil {
+			return nil, err
+		}
+		res, err := NewPunctuator(cfg.URL, cfg.Timeout, settings.Batch)
+		if err != nil {
+			return nil, err
+		}
+		if err := res.SetContext(settings.Context); err != nil {
+			return nil, fmt.Errorf("wrong context: %w", err)
+		}
+		return res, nil
+	})
+	res.Register("http", func(cfg *StageConfig) (Handler, error) {
+		settings := HTTPStageConfig{Transport: DefaultTransportConfig()}
+		if err := decodeSettings(cfg, &settings); err != nil {
+			return nil, err
+		}
+		settings.Name, settings.URL, settings.Timeout = cfg.Name, cfg.URL, cfg.Timeout
+		return NewHTTPStage(settings)
+	})
+	res.Register("process", func(cfg *StageConfig) (Handler, error) {
+		settings := ProcessStageConfig{}
+		if err := decodeSettings(cfg, &settings); err != nil {
+			return nil, err
+		}
+		settings.Name, settings.Timeout = cfg.Name, cfg.Timeout
+		return NewProcessStage(settings)
+	})
+	res.Register("dictionary", func(cfg *StageConfig) (Handler, error) {
+		settings := struct {
+			Reload time.Duration `mapstructure:"reload"`
+			Rules  []struct {
+				From         string `mapstructure:"from"`
+				To           string `mapstructure:"to"`
+				Regex        bool   `mapstructure:"regex"`
+				PreserveCase bool   `mapstructure:"preserveCase"`
+			} `mapstructure:"rules"`
+		}{}
+		if err := decodeSettings(cfg, &settings); err != nil {
+			return nil, err
+		}
+		var rules []domain.DictionaryRule
+		for _, r := range settings.Rules {
+			rules = append(rules, domain.DictionaryRule{From: r.From, To: r.To, Regex: r.Regex, PreserveCase: r.PreserveCase})
+		}
+		return NewDictionary(cfg.Name, rules, res.Dictionaries, settings.Reload)
+	})
+	res.Register("mask", func(cfg *StageConfig) (Handler, error) {
+		settings := MaskerConfig{Enabled: true}
+		if err := decodeSettings(cfg, &settings); err != nil {
+			return nil, err
+		}
+		settings.Name = cfg.Name
+		return NewMasker(settings, res.Configs)
+	})
+	return res
+}
+
+// Register adds or replaces a stage factory
+func (r *Registry) Register(stageType string, f StageFactory) {
+	r.factories[stageType] = f
+}
+
+// Build creates the pipeline from the ordered stage configs
+func (r *Registry) Build(stages []*StageConfig) (*ListHandler, error) {
+	res, err := NewListHandler()
+	if err != nil {
+		return nil, err
+	}
+	res.SetPartialInterval(r.PartialInterval)
+	names := map[string]bool{}
+	for i, cfg := range stages {
+		if cfg.Name == "" {
+			return nil, fmt.Errorf("stage %d: no name", i)
+		}
+		if names[cfg.Name] {
+			return nil, fmt.Errorf("stage %d: duplicate name '%s'", i, cfg.Name)
+		}
+		names[cfg.Name] = true
+		h, err := r.build(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("stage '%s': %w", cfg.Name, err)
+		}
+		if cfg.Async {
+			res.AddAsyncStage(cfg.Name, h, cfg.ForPartials())
+		} else {
+			res.AddStage(cfg.Name, h, cfg.ForPartials())
+		}
+		if cfg.NBest != 0 && cfg.NBest != 1 {
+			if err := res.setNBest(cfg.NBest, h); err != nil {
+				return nil, fmt.Errorf("stage '%s': %w", cfg.Name, err)
+			}
+		}
+	}
+	return res, nil
+}
+
+// Close releases the resources of all built stages, e.g. stops the processes of process stages
+func (r *Registry) Close() error {
+	var res error
+	for _, c := range r.closers {
+		res = errors.Join(res, c.Close())
+	}
+	r.closers = nil
+	return res
+}
+
+func (r *Registry) build(cfg *StageConfig) (Handler, error) {
+	stageType := cfg.Type
+	if stageType == "" {
+		stageType = cfg.Name
+	}
+	f, ok := r.factories[stageType]
+	if !ok {
+		return nil, fmt.Errorf("unknown type '%s'", stageType)
+	}
+	if err := cfg.Policy.validate(); err != nil {
+		return nil, err
+	}
+	h, err := f(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := h.(io.Closer); ok {
+		r.closers = append(r.closers, c)
+	}
+	if err := r.setCache(cfg, h); err != nil {
+		return nil, err
+	}
+	goapp.Log.Info().Str("name", cfg.Name).Str("type", stageType).Bool("partials", cfg.ForPartials()).
+		Str("onError", cfg.OnError).Int("retries", cfg.Retries).Int("breakerFailures", cfg.BreakerFailures).Msg("Pipeline stage")
+	if cfg.OnError == "" && cfg.Retries == 0 && cfg.BreakerFailures == 0 {
+		return h, nil
+	}
+	res := &guardedStage{name: cfg.Name, handler: h, policy: cfg.Policy}
+	if cfg.OnError == PolicyFallback {
+		if cfg.Fallback.Name == "" {
+			cfg.Fallback.Name = cfg.Name + "-fallback"
+		}
+		if res.fallback, err = r.build(cfg.Fallback); err != nil {
+			return nil, fmt.Errorf("fallback: %w", err)
+		}
+	}
+	if cfg.BreakerFailures > 0 {
+		if res.breaker = r.breakers[cfg.Name]; res.breaker == nil {
+			res.breaker = newBreaker(cfg.Name, cfg.BreakerFailures, cfg.BreakerCooldown)
+			r.breakers[cfg.Name] = res.breaker
+		}
+	}
+	return res, nil
+}
+
+func (r *Registry) setCache(cfg *StageConfig, h Handler) error {
+	if cfg.Cache.Size <= 0 {
+		return nil
+	}
+	c, ok := h.(cacheable)
+	if !ok {
+		return fmt.Errorf("stage does not support caching")
+	}
+	if res := r.caches[cfg.Name]; res != nil {
+		c.setCache(res)
+		return nil
+	}
+	ttl := cfg.Cache.TTL
+	if ttl <= 0 {
+		ttl = 10 * time.Minute
+	}
+	res := &stageCache{name: cfg.Name, local: newLRUCache(cfg.Cache.Size, ttl), ttl: ttl}
+	if cfg.Cache.Shared {
+		if r.CacheClient == nil || r.CacheCrypter == nil {
+			return fmt.Errorf("no redis for shared cache")
+		}
+		res.client, res.crypter = r.CacheClient, r.CacheCrypter
+	}
+	goapp.Log.Info().Str("stage", cfg.Name).Int("size", cfg.Cache.Size).Dur("ttl", ttl).Bool("shared", cfg.Cache.Shared).Msg("Stage cache")
+	r.caches[cfg.Name] = res
+	c.setCache(res)
+	return nil
+}
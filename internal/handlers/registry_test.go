@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/airenas/rt-transcriber-wrapper/internal/api"
+)
+
+type testStage struct {
+	suffix string
+}
+
+func (s *testStage) Process(_ context.Context, _ *SessionState, data *api.FullResult) (*api.FullResult, error) {
+	data.Result.Hypotheses[0].Transcript += s.suffix
+	return data, nil
+}
+
+func TestRegistry_Build(t *testing.T) {
+	no := false
+	r := NewRegistry()
+	r.Register("test", func(cfg *StageConfig) (Handler, error) { return &testStage{suffix: cfg.Name}, nil })
+	tests := []struct {
+		name    string
+		stages  []*StageConfig
+		final   bool
+		want    string
+		wantErr bool
+	}{
+		{name: "order", stages: []*StageConfig{{Name: "a", Type: "test"}, {Name: "b", Type: "test"}}, want: "ab"},
+		{name: "skip partial", stages: []*StageConfig{{Name: "a", Type: "test", Partials: &no}, {Name: "b", Type: "test"}}, want: "b"},
+		{name: "final", stages: []*StageConfig{{Name: "a", Type: "test", Partials: &no}}, final: true, want: "a"},
+		{name: "unknown", stages: []*StageConfig{{Name: "a"}}, wantErr: true},
+		{name: "duplicate", stages: []*StageConfig{{Name: "a", Type: "test"}, {Name: "a", Type: "test"}}, wantErr: true},
+		{name: "no name", stages: []*StageConfig{{Type: "test"}}, wantErr: true},
+		{name: "factory fails", stages: []*StageConfig{{Name: "joiner"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := r.Build(tt.stages)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Build() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			res, _ := got.Process(context.Background(), NewSessionState(), &api.FullResult{Result: api.Result{Final: tt.final, Hypotheses: []api.Hypothesis{{}}}})
+			if res.Result.Hypotheses[0].Transcript != tt.want {
+				t.Errorf("Process() = %v, want %v", res.Result.Hypotheses[0].Transcript, tt.want)
+			}
+		})
+	}
+}
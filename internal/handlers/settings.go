@@ -0,0 +1,25 @@
+package handlers
+
+import (
+	"fmt"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+// decodeSettings reads the stage specific settings into out.
+// Unknown keys are rejected, durations accept strings like 1s
+func decodeSettings(cfg *StageConfig, out any) error {
+	d, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook:       mapstructure.StringToTimeDurationHookFunc(),
+		ErrorUnused:      true,
+		WeaklyTypedInput: true,
+		Result:           out,
+	})
+	if err != nil {
+		return err
+	}
+	if err := d.Decode(cfg.Settings); err != nil {
+		return fmt.Errorf("wrong settings: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"io"
+	"sync"
+
+	"github.com/airenas/go-app/pkg/goapp"
+)
+
+// SessionState keeps middleware data of one connection.
+// It is created on connect and released on close, so stages never share data between users
+type SessionState struct {
+	// User is the ID of the connected user
+	User string
+
+	lock   sync.Mutex
+	values map[any]any
+}
+
+// NewSessionState creates an empty state
+func NewSessionState() *SessionState {
+	return &SessionState{values: map[any]any{}}
+}
+
+// Value returns the value of the key, create makes it on the first use.
+// Stages use their own instance as the key
+func (s *SessionState) Value(key any, create func() any) any {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.values == nil {
+		s.values = map[any]any{}
+	}
+	res, ok := s.values[key]
+	if !ok {
+		res = create()
+		s.values[key] = res
+	}
+	return res
+}
+
+// Release drops all values, closing the ones implementing io.Closer
+func (s *SessionState) Release() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, v := range s.values {
+		if c, ok := v.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				goapp.Log.Warn().Err(err).Msg("can't release session value")
+			}
+		}
+	}
+	s.values = nil
+}
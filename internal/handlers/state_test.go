@@ -0,0 +1,28 @@
+package handlers
+
+import "testing"
+
+type closer struct {
+	closed bool
+}
+
+func (c *closer) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestSessionState(t *testing.T) {
+	s1, s2 := NewSessionState(), NewSessionState()
+	key := &Cleaner{}
+	v1 := s1.Value(key, func() any { return &closer{} }).(*closer)
+	if got := s1.Value(key, func() any { return &closer{} }); got != v1 {
+		t.Errorf("Value() created a new value for the same session")
+	}
+	if got := s2.Value(key, func() any { return &closer{} }); got == v1 {
+		t.Errorf("Value() shares a value between sessions")
+	}
+	s1.Release()
+	if !v1.closed {
+		t.Errorf("Release() did not close the value")
+	}
+}
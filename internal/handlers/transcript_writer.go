@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/airenas/go-app/pkg/goapp"
+	"github.com/airenas/rt-transcriber-wrapper/internal/domain"
+)
+
+// transcriptWriter saves transcripts of one session in a background goroutine, so a slow storage
+// does not block the session. Only the newest version of a waiting transcript is saved
+type transcriptWriter struct {
+	saver   TranscriptSaver
+	user    string
+	timeout time.Duration
+
+	lock    sync.Mutex
+	waiting []*domain.Transcript
+	closed  bool
+	signal  chan struct{}
+	done    chan struct{}
+}
+
+func newTranscriptWriter(saver TranscriptSaver, user string) *transcriptWriter {
+	res := &transcriptWriter{saver: saver, user: user, timeout: 10 * time.Second, signal: make(chan struct{}, 1),
+		done: make(chan struct{})}
+	go res.run()
+	return res
+}
+
+// save queues a copy of the transcript, replacing the waiting version with the same ID
+func (w *transcriptWriter) save(t *domain.Transcript) {
+	c := *t
+	c.Segments = slices.Clone(t.Segments)
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return
+	}
+	if i := slices.IndexFunc(w.waiting, func(wt *domain.Transcript) bool { return wt.ID == c.ID }); i >= 0 {
+		w.waiting[i] = &c
+	} else {
+		w.waiting = append(w.waiting, &c)
+	}
+	select {
+	case w.signal <- struct{}{}:
+	default:
+	}
+}
+
+// close saves the waiting transcripts and stops the writer
+func (w *transcriptWriter) close() {
+	w.lock.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.signal)
+	}
+	w.lock.Unlock()
+	<-w.done
+}
+
+func (w *transcriptWriter) run() {
+	defer close(w.done)
+	for range w.signal {
+		for {
+			w.lock.Lock()
+			if len(w.waiting) == 0 {
+				w.lock.Unlock()
+				break
+			}
+			t := w.waiting[0]
+			w.waiting = w.waiting[1:]
+			w.lock.Unlock()
+			w.write(t)
+		}
+	}
+}
+
+func (w *transcriptWriter) write(t *domain.Transcript) {
+	ctx, cf := context.WithTimeout(context.Background(), w.timeout)
+	defer cf()
+	if err := w.saver.SaveTranscript(ctx, w.user, t); err != nil {
+		goapp.Log.Error().Err(err).Str("id", t.ID).Msg("can't save transcript")
+	}
+}
@@ -3,18 +3,23 @@ package handlers
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/airenas/go-app/pkg/goapp"
 	"github.com/airenas/rt-transcriber-wrapper/internal/api"
+	"github.com/airenas/rt-transcriber-wrapper/internal/domain"
 	"github.com/oklog/ulid/v2"
 )
 
 type AudioSaver interface {
-	SaveAudio(ctx context.Context, id string, data [][]byte) error
+	SaveAudio(ctx context.Context, userID string, id string, data [][]byte) error
+}
+
+type TranscriptSaver interface {
+	SaveTranscript(ctx context.Context, userID string, transcript *domain.Transcript) error
 }
 
 type State int
@@ -38,6 +43,7 @@ type TranscriptionSession struct {
 	ID           string
 	stoppingAt   time.Time
 	startPos     *WordPos
+	transcript   *domain.Transcript
 }
 
 type AudioKeeper struct {
@@ -53,33 +59,73 @@ type RecordSession struct {
 	lastCommand   *WordPos
 	lock          sync.Mutex
 
-	audioKeeper *AudioKeeper
-	audioSaver  AudioSaver
-	user        string
-
-	writeFunc func(msg *api.FullResult) error
+	audioKeeper     *AudioKeeper
+	audioSaver      AudioSaver
+	transcriptSaver TranscriptSaver
+	user            string
+	profile         string
+
+	writeFunc   func(msg *api.FullResult) error
+	state       *SessionState
+	async       *asyncRunner
+	transcripts *transcriptWriter
+	// lastPartial is the time of the last processed partial of the current segment
+	lastPartial time.Time
+	// pending is the newest debounced partial, sent by pendingTimer when the interval expires
+	pending      *pendingPartial
+	pendingTimer *time.Timer
 
 	copy_command_segment       int
 	select_all_command_segment int
 	stop_command_segment       int
 }
 
-func NewRecordSession(audioSaver AudioSaver, user string, writeFunc func(msg *api.FullResult) error) *RecordSession {
+type pendingPartial struct {
+	ctx     context.Context
+	handler Handler
+	input   *api.FullResult
+}
+
+func NewRecordSession(audioSaver AudioSaver, transcriptSaver TranscriptSaver, user string, profile string, writeFunc func(msg *api.FullResult) error) *RecordSession {
+	state := NewSessionState()
+	state.User = user
 	return &RecordSession{State: Listening, Auto: true, Segment: 0, copy_command_segment: -1, select_all_command_segment: -1,
-		lastCommand: &WordPos{-1, -1}, audioSaver: audioSaver, user: user, writeFunc: writeFunc}
+		lastCommand: &WordPos{-1, -1}, audioSaver: audioSaver, transcriptSaver: transcriptSaver, user: user, profile: profile, writeFunc: writeFunc,
+		state: state}
 }
 
-func NewTranscriptionSession(segment int, word int) *TranscriptionSession {
-	return &TranscriptionSession{StartSegment: segment, EndSegment: -1, ID: ulid.Make().String(), startPos: &WordPos{Segment: segment, WordIndex: word}}
+func NewTranscriptionSession(user string, segment int, word int) *TranscriptionSession {
+	id := ulid.Make().String()
+	now := time.Now()
+	return &TranscriptionSession{StartSegment: segment, EndSegment: -1, ID: id, startPos: &WordPos{Segment: segment, WordIndex: word},
+		transcript: &domain.Transcript{ID: id, UserID: user, Created: now, Updated: now}}
 }
 
 func (rs *RecordSession) SaveAudio(ctx context.Context) error {
 	if rs.audioKeeper != nil {
-		return rs.audioSaver.SaveAudio(ctx, fmt.Sprintf("audio-%s-%s", rs.user, rs.audioKeeper.ID), rs.audioKeeper.Audio)
+		return rs.audioSaver.SaveAudio(ctx, rs.user, rs.audioKeeper.ID, rs.audioKeeper.Audio)
 	}
 	return nil
 }
 
+// flushAudio saves and releases the kept audio, returns true if the user quota does not allow to save it
+func (rs *RecordSession) flushAudio(ctx context.Context) bool {
+	if rs.audioKeeper == nil {
+		return false
+	}
+	err := rs.SaveAudio(ctx)
+	rs.audioKeeper = nil
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, domain.ErrQuotaExceeded) {
+		goapp.Log.Warn().Err(err).Str("user", rs.user).Msg("can't save audio")
+		return true
+	}
+	goapp.Log.Error().Err(err).Msg("can't save audio")
+	return false
+}
+
 func (rs *RecordSession) KeepAudio(msg []byte) {
 	rs.lock.Lock()
 	defer rs.lock.Unlock()
@@ -94,7 +140,7 @@ func (rs *RecordSession) Start(auto bool) {
 	goapp.Log.Debug().Bool("auto", auto).Msg("Starting transcription")
 	rs.State = Transcribing
 	rs.Auto = auto
-	rs.Transcription = NewTranscriptionSession(rs.Segment, 0)
+	rs.Transcription = NewTranscriptionSession(rs.user, rs.Segment, 0)
 	rs.audioKeeper = &AudioKeeper{ID: rs.Transcription.ID}
 }
 
@@ -102,11 +148,10 @@ func (rs *RecordSession) Stop(ctx context.Context) {
 	rs.lock.Lock()
 	defer rs.lock.Unlock()
 
-	if rs.audioKeeper != nil {
-		if err := rs.SaveAudio(ctx); err != nil {
-			goapp.Log.Error().Err(err).Msg("can't save audio")
+	if rs.flushAudio(ctx) {
+		if err := rs.writeFunc(&api.FullResult{Event: api.EventQuotaExceeded}); err != nil {
+			goapp.Log.Error().Err(err).Msg("can't send quota event")
 		}
-		rs.audioKeeper = nil
 	}
 	if rs.State == Transcribing {
 		rs.State = StoppingTranscription
@@ -143,11 +188,22 @@ func getText(input *api.FullResult) string {
 	return input.Result.Hypotheses[0].Transcript
 }
 
+func getMasked(input *api.FullResult) []int {
+	if input == nil || len(input.Result.Hypotheses) == 0 {
+		return nil
+	}
+	return input.Result.Hypotheses[0].Masked
+}
+
 func (rs *RecordSession) Process(ctx context.Context, input *api.FullResult, handler Handler) ([]*api.FullResult, error) {
 	rs.lock.Lock()
 	defer rs.lock.Unlock()
 	goapp.Log.Trace().Int("segment", input.Segment).Str("txt", getText(input)).Str("state", rs.State.String()).Bool("final", input.Result.Final).
 		Interface("last_command", rs.lastCommand).Send()
+	if rs.Segment != input.Segment {
+		rs.lastPartial = time.Time{}
+		rs.dropPending()
+	}
 	rs.Segment = input.Segment
 	lastCommand := rs.lastCommand
 
@@ -161,9 +217,9 @@ func (rs *RecordSession) Process(ctx context.Context, input *api.FullResult, han
 		if indexStart >= 0 {
 			rs.lastCommand = &WordPos{Segment: rs.Segment, WordIndex: indexStart}
 			rs.State = Transcribing
-			rs.Transcription = NewTranscriptionSession(rs.Segment, indexStart)
+			rs.Transcription = NewTranscriptionSession(rs.user, rs.Segment, indexStart)
 			rs.audioKeeper = &AudioKeeper{ID: rs.Transcription.ID}
-			res = append(res, &api.FullResult{Event: api.EventStart, TranscriptionID: rs.Transcription.ID})
+			res = append(res, &api.FullResult{Event: api.EventStart, TranscriptionID: rs.Transcription.ID, Profile: rs.profile})
 		} else {
 			found := false
 			if rs.copy_command_segment < rs.Segment {
@@ -204,11 +260,8 @@ func (rs *RecordSession) Process(ctx context.Context, input *api.FullResult, han
 		if indexStop >= 0 {
 			rs.State = StoppingTranscription
 			rs.lastCommand = &WordPos{Segment: rs.Segment, WordIndex: indexStop}
-			if rs.audioKeeper != nil {
-				if err := rs.SaveAudio(ctx); err != nil {
-					goapp.Log.Error().Err(err).Msg("can't save audio")
-				}
-				rs.audioKeeper = nil
+			if rs.flushAudio(ctx) {
+				res = append(res, &api.FullResult{Event: api.EventQuotaExceeded})
 			}
 			if rs.Transcription != nil {
 				rs.Transcription.EndSegment = rs.Segment
@@ -241,7 +294,11 @@ func (rs *RecordSession) Process(ctx context.Context, input *api.FullResult, han
 		}
 	}
 
-	inputProcessed, err := handler.Process(ctx, input)
+	if rs.skipPartial(ctx, handler, input) {
+		rs.State = nextState
+		return res, nil
+	}
+	inputProcessed, err := rs.process(ctx, handler, input)
 	if err != nil {
 		return nil, err
 	}
@@ -250,6 +307,167 @@ func (rs *RecordSession) Process(ctx context.Context, input *api.FullResult, han
 	return res, nil
 }
 
+// process passes the result through the pipeline, the async part is started in background
+func (rs *RecordSession) process(ctx context.Context, handler Handler, input *api.FullResult) (*api.FullResult, error) {
+	var asyncHandler Handler
+	if s, ok := handler.(splitter); ok {
+		handler, asyncHandler = s.Split()
+	}
+	res, err := handler.Process(ctx, rs.state, input)
+	if err != nil {
+		return nil, err
+	}
+	rs.keepTranscript(res)
+	if asyncHandler != nil {
+		if rs.async == nil {
+			rs.async = newAsyncRunner(ctx, rs.deliverAsync)
+		}
+		rs.async.add(asyncHandler, rs.state, res)
+	}
+	return res, nil
+}
+
+// skipPartial debounces partial results of a segment, so the stages are called at most once per the pipeline interval.
+// The newest skipped partial replaces the pending one and is sent when the interval expires, a final result drops it
+func (rs *RecordSession) skipPartial(ctx context.Context, handler Handler, input *api.FullResult) bool {
+	l, ok := handler.(partialLimiter)
+	if !ok || l.PartialInterval() <= 0 {
+		return false
+	}
+	if input.Result.Final {
+		rs.dropPending()
+		return false
+	}
+	now := time.Now()
+	if wait := l.PartialInterval() - now.Sub(rs.lastPartial); wait > 0 {
+		if rs.pending == nil {
+			rs.pendingTimer = time.AfterFunc(wait, rs.flushPartial)
+		} else {
+			countSkipped(rs.pending.handler)
+		}
+		rs.pending = &pendingPartial{ctx: ctx, handler: handler, input: input}
+		return true
+	}
+	rs.dropPending()
+	rs.lastPartial = now
+	return false
+}
+
+// flushPartial sends the pending partial if it is still of the current segment
+func (rs *RecordSession) flushPartial() {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	p := rs.pending
+	rs.pending, rs.pendingTimer = nil, nil
+	if p == nil {
+		return
+	}
+	if p.input.Segment != rs.Segment || p.ctx.Err() != nil {
+		countSkipped(p.handler)
+		return
+	}
+	rs.lastPartial = time.Now()
+	res, err := rs.process(p.ctx, p.handler, p.input)
+	if err != nil {
+		goapp.Log.Warn().Err(err).Int("segment", p.input.Segment).Msg("drop pending partial")
+		return
+	}
+	if err := rs.writeFunc(res); err != nil {
+		goapp.Log.Error().Err(err).Msg("can't send partial")
+	}
+}
+
+// dropPending cancels the pending partial, a newer result replaces it
+func (rs *RecordSession) dropPending() {
+	if rs.pendingTimer != nil {
+		rs.pendingTimer.Stop()
+	}
+	if rs.pending != nil {
+		countSkipped(rs.pending.handler)
+	}
+	rs.pending, rs.pendingTimer = nil, nil
+}
+
+func countSkipped(h Handler) {
+	partialsSkipped.WithLabelValues("debounce").Inc()
+	if l, ok := h.(partialLimiter); ok {
+		callsSaved.Add(float64(l.PartialStages()))
+	}
+}
+
+// deliverAsync sends the background result as corrections, unless a newer hypothesis of the segment exists
+func (rs *RecordSession) deliverAsync(ctx context.Context, job *asyncJob, result *api.FullResult) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	if !rs.async.isLatest(job) {
+		goapp.Log.Debug().Int("segment", job.data.Segment).Msg("drop stale async result")
+		return
+	}
+	update := &api.FullResult{Event: api.EventUpdate, Segment: result.Segment}
+	update.OldUpdates = append(update.OldUpdates, result.OldUpdates...)
+	update.OldUpdates = append(update.OldUpdates, &api.ShortResult{Segment: result.Segment, Transcript: getText(result),
+		Final: result.Result.Final, Masked: getMasked(result)})
+	rs.keepTranscript(update)
+	if err := rs.writeFunc(update); err != nil {
+		goapp.Log.Error().Err(err).Msg("can't send update")
+	}
+}
+
+// Close stops background processing, waits for the transcript saves and releases the middleware state of the session
+func (rs *RecordSession) Close() {
+	rs.lock.Lock()
+	async := rs.async
+	rs.dropPending()
+	rs.lock.Unlock()
+	if async != nil {
+		async.close()
+	}
+	rs.lock.Lock()
+	transcripts := rs.transcripts
+	rs.transcripts = nil
+	rs.lock.Unlock()
+	if transcripts != nil {
+		transcripts.close()
+	}
+	rs.state.Release()
+}
+
+// keepTranscript collects final results and punctuation updates of the active transcription
+// and saves them in background on every change, so the dictation survives a closed client
+func (rs *RecordSession) keepTranscript(result *api.FullResult) {
+	if rs.Transcription == nil || rs.transcriptSaver == nil || result == nil {
+		return
+	}
+	transcript := rs.Transcription.transcript
+	changed := false
+	for _, u := range result.OldUpdates {
+		if transcript.UpdateText(u.Segment, u.Transcript) {
+			changed = true
+		}
+	}
+	if result.Result.Final && len(result.Result.Hypotheses) > 0 {
+		transcript.SetSegment(toTranscriptSegment(result))
+		changed = true
+	}
+	if !changed {
+		return
+	}
+	if rs.transcripts == nil {
+		rs.transcripts = newTranscriptWriter(rs.transcriptSaver, rs.user)
+	}
+	rs.transcripts.save(transcript)
+}
+
+func toTranscriptSegment(result *api.FullResult) domain.TranscriptSegment {
+	hyp := result.Result.Hypotheses[0]
+	res := domain.TranscriptSegment{Segment: result.Segment, Start: result.SegmentStart,
+		Length: result.SegmentLength, Text: hyp.Transcript}
+	for _, wa := range hyp.WordAlignment {
+		res.Words = append(res.Words, domain.Word{Start: wa.Start, Length: wa.Length, Word: wa.Word, Confidence: wa.Confidence})
+	}
+	return res
+}
+
 func clearWordsTo(input *api.FullResult, indexStop int) *api.FullResult {
 	if !input.Result.Final {
 		words := strings.Split(input.Result.Hypotheses[0].Transcript, " ")
@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/airenas/rt-transcriber-wrapper/internal/api"
+	"github.com/airenas/rt-transcriber-wrapper/internal/domain"
+)
+
+type testTranscriptSaver struct {
+	release chan struct{}
+	err     error
+
+	lock  sync.Mutex
+	saved []string
+}
+
+func (s *testTranscriptSaver) SaveTranscript(_ context.Context, _ string, t *domain.Transcript) error {
+	if s.release != nil {
+		<-s.release
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.saved = append(s.saved, t.Text())
+	return s.err
+}
+
+func (s *testTranscriptSaver) texts() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string(nil), s.saved...)
+}
+
+func TestRecordSession_keepTranscript(t *testing.T) {
+	tests := []struct {
+		name    string
+		results []*api.FullResult
+		err     error
+		want    []string
+	}{
+		{name: "partial", results: []*api.FullResult{testResult(1, "a", false)}},
+		{name: "final", results: []*api.FullResult{testResult(1, "a", false), testResult(1, "a b", true)}, want: []string{"a b"}},
+		{name: "update", results: []*api.FullResult{testResult(1, "a", true),
+			{OldUpdates: []*api.ShortResult{{Segment: 1, Transcript: "A."}}}}, want: []string{"a", "A."}},
+		{name: "same update", results: []*api.FullResult{testResult(1, "a", true),
+			{OldUpdates: []*api.ShortResult{{Segment: 1, Transcript: "a"}}}}, want: []string{"a"}},
+		{name: "error", results: []*api.FullResult{testResult(1, "a", true), testResult(2, "b", true)},
+			err: errors.New("fail"), want: []string{"a", "a b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saver := &testTranscriptSaver{err: tt.err}
+			rs := NewRecordSession(nil, saver, "u", "", nil)
+			rs.Start(false)
+			for _, r := range tt.results {
+				rs.keepTranscript(r)
+				time.Sleep(10 * time.Millisecond) // saved one by one
+			}
+			rs.Close()
+			if got := saver.texts(); !slices.Equal(got, tt.want) {
+				t.Errorf("saved = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecordSession_keepTranscript_slowSaver(t *testing.T) {
+	saver := &testTranscriptSaver{release: make(chan struct{})}
+	rs := NewRecordSession(nil, saver, "u", "", nil)
+	rs.Start(false)
+	start := time.Now()
+	rs.keepTranscript(testResult(1, "a", true))
+	time.Sleep(10 * time.Millisecond) // "a" is being saved
+	rs.keepTranscript(testResult(2, "b", true))
+	rs.keepTranscript(testResult(3, "c", true))
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("keepTranscript() blocked for %v", d)
+	}
+	close(saver.release)
+	rs.Close()
+	if got, want := saver.texts(), []string{"a", "a b c"}; !slices.Equal(got, want) {
+		t.Errorf("saved = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,124 @@
+package secure
+
+import (
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// formatV2 marks ciphertexts encrypted with a per-user key derived by HKDF.
+// Additional data binds the ciphertext to its data type and storage key
+const formatV2 byte = 2
+
+// Binding describes where the ciphertext belongs
+type Binding struct {
+	// Type is a data type, e.g. audio, texts
+	Type string
+	// User is an owner, used to derive the user key
+	User string
+	// Key is a storage key
+	Key string
+}
+
+// RejectUnbound disables decryption of legacy and key ID only ciphertexts in DecryptFor.
+// Enable it when all data is migrated
+func (c *Crypter) RejectUnbound(reject bool) {
+	c.rejectUnbound = reject
+}
+
+// EncryptFor encrypts data with the active key derived for the binding user
+func (c *Crypter) EncryptFor(data []byte, b Binding) ([]byte, error) {
+	header := makeHeaderV(formatV2, c.active)
+	key, err := deriveKey(c.keys[c.active], b.User)
+	if err != nil {
+		return nil, err
+	}
+	aesgcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aesgcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	res := make([]byte, 0, len(header)+len(nonce)+len(data)+aesgcm.Overhead())
+	res = append(res, header...)
+	res = append(res, nonce...)
+	return aesgcm.Seal(res, nonce, data, additionalData(header, b)), nil
+}
+
+// DecryptFor decrypts data encrypted by EncryptFor, fails if the binding does not match.
+// Unbound ciphertexts are accepted unless RejectUnbound is set
+func (c *Crypter) DecryptFor(data []byte, b Binding) ([]byte, error) {
+	res, _, err := c.decryptFor(data, b)
+	return res, err
+}
+
+// Reencrypt encrypts data with the active key for the binding if it was encrypted with another key
+// or in an older format. Returns false if the data is already up to date
+func (c *Crypter) Reencrypt(data []byte, b Binding) ([]byte, bool, error) {
+	plain, current, err := c.decryptFor(data, b)
+	if err != nil {
+		return nil, false, err
+	}
+	if current {
+		return data, false, nil
+	}
+	res, err := c.EncryptFor(plain, b)
+	if err != nil {
+		return nil, false, err
+	}
+	return res, true, nil
+}
+
+func (c *Crypter) decryptFor(data []byte, b Binding) ([]byte, bool, error) {
+	res, current, errBound := c.decryptBound(data, b)
+	if errBound == nil {
+		return res, current, nil
+	}
+	if c.rejectUnbound {
+		return nil, false, errBound
+	}
+	// an unbound decryption can't succeed on a bound ciphertext, so a binding mismatch still fails
+	if res, _, err := c.decrypt(data); err == nil {
+		return res, false, nil
+	}
+	return nil, false, errBound
+}
+
+func (c *Crypter) decryptBound(data []byte, b Binding) ([]byte, bool, error) {
+	id, header, body, ok := parseHeaderV(formatV2, data)
+	if !ok {
+		return nil, false, errors.New("can't decrypt: not a bound ciphertext")
+	}
+	master, ok := c.keys[id]
+	if !ok {
+		return nil, false, fmt.Errorf("can't decrypt: unknown key '%s'", id)
+	}
+	key, err := deriveKey(master, b.User)
+	if err != nil {
+		return nil, false, err
+	}
+	res, err := open(key, body, additionalData(header, b))
+	if err != nil {
+		return nil, false, fmt.Errorf("can't decrypt %s '%s': binding mismatch or corrupted data: %w", b.Type, b.Key, err)
+	}
+	return res, id == c.active, nil
+}
+
+func deriveKey(master []byte, user string) ([]byte, error) {
+	return hkdf.Key(sha256.New, master, nil, "rt-transcriber-wrapper/user/"+user, 32)
+}
+
+func additionalData(header []byte, b Binding) []byte {
+	res := make([]byte, 0, len(header)+len(b.Type)+len(b.Key)+1)
+	res = append(res, header...)
+	res = append(res, b.Type...)
+	res = append(res, 0)
+	return append(res, b.Key...)
+}
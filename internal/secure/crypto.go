@@ -4,31 +4,59 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"io"
 )
 
+// DefaultKeyID is used when the crypter is created from a single key
+const DefaultKeyID = "default"
+
+// formatV1 marks ciphertexts with a key ID header: [version][len(id)][id][nonce][sealed data].
+// The header is authenticated as additional data.
+// Ciphertexts without the header (legacy) are decrypted by trying all keys
+const formatV1 byte = 1
+
+// Crypter is a keyring - it encrypts with the active key and decrypts with any known key
 type Crypter struct {
-	key []byte
+	keys   map[string][]byte
+	active string
+
+	rejectUnbound bool
 }
 
-func NewCrypter(key string) (*Crypter, error) {
-	k := []byte(key)
-	l := len(k)
-	if l < 32 {
-		return nil, fmt.Errorf("key length must be >= 32 bytes, got %d", l)
-	}
-	k = k[:32]
-	return &Crypter{key: k}, nil
+// NewCrypter creates a crypter with one key
+func NewCrypter(key []byte) (*Crypter, error) {
+	return NewKeyring(map[string][]byte{DefaultKeyID: key}, DefaultKeyID)
 }
 
-func (c *Crypter) Encrypt(data []byte) ([]byte, error) {
-	block, err := aes.NewCipher(c.key)
-	if err != nil {
-		return nil, err
+// NewKeyring creates a crypter from several keys, the key with activeID is used for encryption.
+// Use ParseKey to decode keys from config
+func NewKeyring(keys map[string][]byte, activeID string) (*Crypter, error) {
+	res := &Crypter{keys: make(map[string][]byte, len(keys)), active: activeID}
+	for id, key := range keys {
+		if id == "" || len(id) > 255 {
+			return nil, fmt.Errorf("wrong key id '%s'", id)
+		}
+		if len(key) != KeySize {
+			return nil, fmt.Errorf("key '%s' must be %d bytes, got %d", id, KeySize, len(key))
+		}
+		res.keys[id] = key
+	}
+	if _, ok := res.keys[activeID]; !ok {
+		return nil, fmt.Errorf("no active key '%s'", activeID)
 	}
+	return res, nil
+}
+
+// ActiveKeyID returns the ID of the key used for encryption
+func (c *Crypter) ActiveKeyID() string {
+	return c.active
+}
 
-	aesgcm, err := cipher.NewGCM(block)
+func (c *Crypter) Encrypt(data []byte) ([]byte, error) {
+	header := makeHeaderV(formatV1, c.active)
+	aesgcm, err := newGCM(c.keys[c.active])
 	if err != nil {
 		return nil, err
 	}
@@ -38,17 +66,53 @@ func (c *Crypter) Encrypt(data []byte) ([]byte, error) {
 		return nil, err
 	}
 
-	return aesgcm.Seal(nonce, nonce, data, nil), nil
+	res := make([]byte, 0, len(header)+len(nonce)+len(data)+aesgcm.Overhead())
+	res = append(res, header...)
+	res = append(res, nonce...)
+	return aesgcm.Seal(res, nonce, data, header), nil
 }
 
 // Decrypt accepts raw ciphertext ([]byte)
 func (c *Crypter) Decrypt(data []byte) ([]byte, error) {
-	block, err := aes.NewCipher(c.key)
-	if err != nil {
-		return nil, err
+	res, _, err := c.decrypt(data)
+	return res, err
+}
+
+func (c *Crypter) decrypt(data []byte) ([]byte, bool, error) {
+	if id, header, body, ok := parseHeaderV(formatV1, data); ok {
+		if key, ok := c.keys[id]; ok {
+			if res, err := open(key, body, header); err == nil {
+				return res, id == c.active, nil
+			}
+		}
+	}
+	for _, key := range c.keys {
+		if res, err := open(key, data, nil); err == nil {
+			return res, false, nil
+		}
+	}
+	return nil, false, errors.New("can't decrypt: no matching key")
+}
+
+func makeHeaderV(version byte, id string) []byte {
+	res := make([]byte, 0, len(id)+2)
+	res = append(res, version, byte(len(id)))
+	return append(res, id...)
+}
+
+func parseHeaderV(version byte, data []byte) (string, []byte, []byte, bool) {
+	if len(data) < 2 || data[0] != version {
+		return "", nil, nil, false
 	}
+	l := int(data[1])
+	if l == 0 || len(data) < l+2 {
+		return "", nil, nil, false
+	}
+	return string(data[2 : l+2]), data[:l+2], data[l+2:], true
+}
 
-	aesgcm, err := cipher.NewGCM(block)
+func open(key, data, additional []byte) ([]byte, error) {
+	aesgcm, err := newGCM(key)
 	if err != nil {
 		return nil, err
 	}
@@ -59,5 +123,13 @@ func (c *Crypter) Decrypt(data []byte) ([]byte, error) {
 	}
 
 	nonce, ciphertext := data[:nonceSize], data[nonceSize:]
-	return aesgcm.Open(nil, nonce, ciphertext, nil)
+	return aesgcm.Open(nil, nonce, ciphertext, additional)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
 }
@@ -1,6 +1,8 @@
 package secure_test
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
 	"testing"
 
 	"github.com/airenas/rt-transcriber-wrapper/internal/secure"
@@ -20,8 +22,8 @@ func TestCrypter_EncryptDecrypt(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			key := "testkey12345678901234567890123456"
-			c, err := secure.NewCrypter(key)
+			key := "testkey1234567890123456789012345"
+			c, err := secure.NewCrypter([]byte(key))
 			if err != nil {
 				t.Fatalf("could not construct receiver type: %v", err)
 			}
@@ -55,11 +57,11 @@ func TestNewCrypter(t *testing.T) {
 		{"valid 16", "1234567890123456", true},
 		{"too short", "1234567890", true},
 		{"empty", "", true},
-		{"valid >32", "12345678901234567890123456789012345", false},
+		{">32", "12345678901234567890123456789012345", true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, gotErr := secure.NewCrypter(tt.key)
+			got, gotErr := secure.NewCrypter([]byte(tt.key))
 			if gotErr != nil {
 				if !tt.wantErr {
 					t.Errorf("NewCrypter() failed: %v", gotErr)
@@ -75,3 +77,140 @@ func TestNewCrypter(t *testing.T) {
 		})
 	}
 }
+
+func TestKeyring_Rotation(t *testing.T) {
+	k1, k2 := []byte("11111111111111111111111111111111"), []byte("22222222222222222222222222222222")
+	old, err := secure.NewKeyring(map[string][]byte{"k1": k1}, "k1")
+	if err != nil {
+		t.Fatalf("NewKeyring() failed: %v", err)
+	}
+	b := secure.Binding{Type: "texts", User: "alice", Key: "texts:alice"}
+	encrypted, err := old.EncryptFor([]byte("data"), b)
+	if err != nil {
+		t.Fatalf("Encrypt() failed: %v", err)
+	}
+
+	c, err := secure.NewKeyring(map[string][]byte{"k1": k1, "k2": k2}, "k2")
+	if err != nil {
+		t.Fatalf("NewKeyring() failed: %v", err)
+	}
+	reencrypted, changed, err := c.Reencrypt(encrypted, b)
+	if err != nil {
+		t.Fatalf("Reencrypt() failed: %v", err)
+	}
+	if !changed {
+		t.Errorf("Reencrypt() changed = false, want true")
+	}
+	if _, changed, _ := c.Reencrypt(reencrypted, b); changed {
+		t.Errorf("Reencrypt() of current data changed = true, want false")
+	}
+
+	onlyNew, err := secure.NewKeyring(map[string][]byte{"k2": k2}, "k2")
+	if err != nil {
+		t.Fatalf("NewKeyring() failed: %v", err)
+	}
+	if _, err := onlyNew.DecryptFor(encrypted, b); err == nil {
+		t.Errorf("DecryptFor() with removed key succeeded unexpectedly")
+	}
+	decrypted, err := onlyNew.DecryptFor(reencrypted, b)
+	if err != nil {
+		t.Fatalf("DecryptFor() failed: %v", err)
+	}
+	if string(decrypted) != "data" {
+		t.Errorf("DecryptFor() = %v, want %v", string(decrypted), "data")
+	}
+}
+
+func TestKeyring_Legacy(t *testing.T) {
+	key := []byte("12345678901234567890123456789012")
+	block, _ := aes.NewCipher(key)
+	aesgcm, _ := cipher.NewGCM(block)
+	nonce := make([]byte, aesgcm.NonceSize())
+	legacy := aesgcm.Seal(nonce, nonce, []byte("legacy"), nil)
+
+	c, err := secure.NewKeyring(map[string][]byte{"old": key, "new": []byte("22222222222222222222222222222222")}, "new")
+	if err != nil {
+		t.Fatalf("NewKeyring() failed: %v", err)
+	}
+	decrypted, err := c.Decrypt(legacy)
+	if err != nil {
+		t.Fatalf("Decrypt() failed: %v", err)
+	}
+	if string(decrypted) != "legacy" {
+		t.Errorf("Decrypt() = %v, want %v", string(decrypted), "legacy")
+	}
+	b := secure.Binding{Type: "texts", User: "alice", Key: "texts:alice"}
+	migrated, changed, err := c.Reencrypt(legacy, b)
+	if err != nil || !changed {
+		t.Fatalf("Reencrypt() of legacy data = %v, %v, want changed", changed, err)
+	}
+	c.RejectUnbound(true)
+	if _, err := c.DecryptFor(legacy, b); err == nil {
+		t.Errorf("DecryptFor() of legacy data with RejectUnbound succeeded unexpectedly")
+	}
+	if _, err := c.DecryptFor(migrated, b); err != nil {
+		t.Errorf("DecryptFor() of migrated data failed: %v", err)
+	}
+}
+
+func TestCrypter_Binding(t *testing.T) {
+	c, err := secure.NewCrypter([]byte("12345678901234567890123456789012"))
+	if err != nil {
+		t.Fatalf("NewCrypter() failed: %v", err)
+	}
+	b := secure.Binding{Type: "texts", User: "alice", Key: "texts:alice"}
+	encrypted, err := c.EncryptFor([]byte("data"), b)
+	if err != nil {
+		t.Fatalf("EncryptFor() failed: %v", err)
+	}
+	tests := []struct {
+		name    string
+		b       secure.Binding
+		wantErr bool
+	}{
+		{"same", b, false},
+		{"other user", secure.Binding{Type: "texts", User: "bob", Key: "texts:bob"}, true},
+		{"other key", secure.Binding{Type: "texts", User: "alice", Key: "texts:bob"}, true},
+		{"other type", secure.Binding{Type: "config", User: "alice", Key: "texts:alice"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, gotErr := c.DecryptFor(encrypted, tt.b)
+			if gotErr != nil {
+				if !tt.wantErr {
+					t.Errorf("DecryptFor() failed: %v", gotErr)
+				}
+				return
+			}
+			if tt.wantErr {
+				t.Fatal("DecryptFor() succeeded unexpectedly")
+			}
+			if string(got) != "data" {
+				t.Errorf("DecryptFor() = %v, want %v", string(got), "data")
+			}
+		})
+	}
+}
+
+func TestNewKeyring(t *testing.T) {
+	key := []byte("12345678901234567890123456789012")
+	tests := []struct {
+		name    string
+		keys    map[string][]byte
+		active  string
+		wantErr bool
+	}{
+		{"ok", map[string][]byte{"a": key, "b": key}, "b", false},
+		{"no active", map[string][]byte{"a": key}, "b", true},
+		{"empty id", map[string][]byte{"": key}, "", true},
+		{"short key", map[string][]byte{"a": key, "b": []byte("123")}, "a", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, gotErr := secure.NewKeyring(tt.keys, tt.active)
+			if (gotErr != nil) != tt.wantErr {
+				t.Errorf("NewKeyring() err = %v, wantErr %v", gotErr, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package secure
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// KeySize is the AES-256 key size
+const KeySize = 32
+
+// minEntropyBits is the minimal estimated entropy of raw and passphrase keys
+const minEntropyBits = 128
+
+// placeholders are example keys published in the repository configs
+var placeholders = []string{
+	"01K6CZRXNCNZZ1HQHMVGGJAD1601K6CZ",
+}
+
+// ParseKey decodes a key from the spec:
+//
+//	hex:<64 hex chars>
+//	base64:<32 bytes in std base64>
+//	argon2id:<base64 salt>:<passphrase> - the key is derived with Argon2id
+//	file:<path> - reads a spec from the file
+//	env:<name> - reads a spec from the environment variable
+//
+// A spec without a prefix is a legacy raw key of exactly 32 bytes
+func ParseKey(spec string) ([]byte, error) {
+	return parseKey(spec, true)
+}
+
+func parseKey(spec string, allowRef bool) ([]byte, error) {
+	prefix, value, found := strings.Cut(spec, ":")
+	if !found {
+		return rawKey(spec)
+	}
+	switch prefix {
+	case "hex":
+		res, err := hex.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("decode hex key: %w", err)
+		}
+		return checkSize(res)
+	case "base64":
+		res, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("decode base64 key: %w", err)
+		}
+		return checkSize(res)
+	case "argon2id":
+		return passphraseKey(value)
+	case "file", "env":
+		if !allowRef {
+			return nil, fmt.Errorf("nested key reference '%s'", prefix)
+		}
+		ref, err := readRef(prefix, value)
+		if err != nil {
+			return nil, err
+		}
+		return parseKey(ref, false)
+	}
+	return rawKey(spec)
+}
+
+// IsPlaceholder checks if the key is a known example key or has no entropy at all
+func IsPlaceholder(key []byte) bool {
+	for _, p := range placeholders {
+		if bytes.Equal(key, []byte(p)) {
+			return true
+		}
+	}
+	for _, b := range key {
+		if b != key[0] {
+			return false
+		}
+	}
+	return true
+}
+
+func readRef(kind, name string) (string, error) {
+	if kind == "env" {
+		res, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("no env variable '%s'", name)
+		}
+		return strings.TrimSpace(res), nil
+	}
+	res, err := os.ReadFile(name)
+	if err != nil {
+		return "", fmt.Errorf("read key file: %w", err)
+	}
+	return strings.TrimSpace(string(res)), nil
+}
+
+func rawKey(key string) ([]byte, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("raw key must be %d bytes, got %d (older versions used the first %d bytes)", KeySize, len(key), KeySize)
+	}
+	if e := entropyBits(key); e < minEntropyBits {
+		return nil, fmt.Errorf("key entropy is too low: ~%d bits, want >= %d", e, minEntropyBits)
+	}
+	return []byte(key), nil
+}
+
+func passphraseKey(value string) ([]byte, error) {
+	saltStr, pass, ok := strings.Cut(value, ":")
+	if !ok {
+		return nil, fmt.Errorf("argon2id key must be argon2id:<salt>:<passphrase>")
+	}
+	salt, err := base64.StdEncoding.DecodeString(saltStr)
+	if err != nil {
+		return nil, fmt.Errorf("decode salt: %w", err)
+	}
+	if len(salt) < 16 {
+		return nil, fmt.Errorf("salt must be >= 16 bytes, got %d", len(salt))
+	}
+	if e := entropyBits(pass); e < minEntropyBits/2 {
+		return nil, fmt.Errorf("passphrase entropy is too low: ~%d bits", e)
+	}
+	return argon2.IDKey([]byte(pass), salt, 3, 64*1024, 4, KeySize), nil
+}
+
+func checkSize(key []byte) ([]byte, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("key must be %d bytes, got %d", KeySize, len(key))
+	}
+	return key, nil
+}
+
+// entropyBits is a rough estimate: length * log2(alphabet of the used character classes),
+// limited by the number of distinct characters
+func entropyBits(s string) int {
+	lower, upper, digit, other := false, false, false, false
+	distinct := map[rune]bool{}
+	for _, r := range s {
+		distinct[r] = true
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		default:
+			other = true
+		}
+	}
+	alphabet := 0
+	for _, c := range []struct {
+		used bool
+		size int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {other, 33}} {
+		if c.used {
+			alphabet += c.size
+		}
+	}
+	if alphabet == 0 {
+		return 0
+	}
+	alphabet = min(alphabet, len(distinct)*2)
+	return int(float64(len([]rune(s))) * math.Log2(float64(alphabet)))
+}
@@ -0,0 +1,100 @@
+package secure_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/airenas/rt-transcriber-wrapper/internal/secure"
+)
+
+func TestParseKey(t *testing.T) {
+	hexKey := "hex:000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	want := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27,
+		28, 29, 30, 31}
+	file := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(file, []byte(hexKey+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_KEY", "base64:AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=")
+	t.Setenv("TEST_REF", "env:TEST_KEY")
+
+	tests := []struct {
+		name    string
+		spec    string
+		want    []byte
+		wantErr bool
+	}{
+		{name: "hex", spec: hexKey, want: want},
+		{name: "base64", spec: "base64:AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=", want: want},
+		{name: "file", spec: "file:" + file, want: want},
+		{name: "env", spec: "env:TEST_KEY", want: want},
+		{name: "raw", spec: "aB3#dE6&gH9*jK2@mN5!pQ8%sT1^vW4$", want: []byte("aB3#dE6&gH9*jK2@mN5!pQ8%sT1^vW4$")},
+		{name: "hex short", spec: "hex:0001", wantErr: true},
+		{name: "hex invalid", spec: "hex:zz", wantErr: true},
+		{name: "base64 invalid", spec: "base64:%%", wantErr: true},
+		{name: "no env", spec: "env:TEST_NO_SUCH_KEY", wantErr: true},
+		{name: "no file", spec: "file:/no/such/file", wantErr: true},
+		{name: "nested ref", spec: "env:TEST_REF", wantErr: true},
+		{name: "raw long", spec: "aB3#dE6&gH9*jK2@mN5!pQ8%sT1^vW4$xx", wantErr: true},
+		{name: "raw low entropy", spec: "12345678901234567890123456789012", wantErr: true},
+		{name: "raw same", spec: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", wantErr: true},
+		{name: "argon2id weak", spec: "argon2id:AAECAwQFBgcICQoLDA0ODw==:secret", wantErr: true},
+		{name: "argon2id short salt", spec: "argon2id:AAEC:correct horse battery staple", wantErr: true},
+		{name: "argon2id no salt", spec: "argon2id:correct horse battery staple", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, gotErr := secure.ParseKey(tt.spec)
+			if gotErr != nil {
+				if !tt.wantErr {
+					t.Errorf("ParseKey() failed: %v", gotErr)
+				}
+				return
+			}
+			if tt.wantErr {
+				t.Fatal("ParseKey() succeeded unexpectedly")
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("ParseKey() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseKey_Argon2id(t *testing.T) {
+	spec := "argon2id:AAECAwQFBgcICQoLDA0ODw==:correct horse battery staple"
+	k1, err := secure.ParseKey(spec)
+	if err != nil {
+		t.Fatalf("ParseKey() failed: %v", err)
+	}
+	k2, _ := secure.ParseKey(spec)
+	if len(k1) != secure.KeySize || !bytes.Equal(k1, k2) {
+		t.Errorf("ParseKey() = %v, %v, want equal %d bytes keys", k1, k2, secure.KeySize)
+	}
+	k3, _ := secure.ParseKey("argon2id:AQECAwQFBgcICQoLDA0ODw==:correct horse battery staple")
+	if bytes.Equal(k1, k3) {
+		t.Errorf("ParseKey() with other salt returned the same key")
+	}
+}
+
+func TestIsPlaceholder(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+		want bool
+	}{
+		{"config", "01K6CZRXNCNZZ1HQHMVGGJAD1601K6CZ", true},
+		{"zeros", string(make([]byte, 32)), true},
+		{"same", "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", true},
+		{"ok", "aB3#dE6&gH9*jK2@mN5!pQ8%sT1^vW4$", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := secure.IsPlaceholder([]byte(tt.key)); got != tt.want {
+				t.Errorf("IsPlaceholder() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
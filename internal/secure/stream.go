@@ -0,0 +1,373 @@
+package secure
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+)
+
+// formatStream marks segmented ciphertexts: [version][len(id)][id][nonce prefix] followed by segments.
+// Every segment holds StreamSegmentSize bytes of data (the last one may be shorter) sealed with
+// the nonce [prefix][segment counter][final flag], so a segment can't be reordered, dropped or
+// marked as the last one. The key is derived per user and the header is bound like in EncryptFor
+const formatStream byte = 3
+
+// StreamSegmentSize is the size of plain data in one segment
+const StreamSegmentSize = 64 * 1024
+
+const noncePrefixSize = 7
+
+// IsStream checks if data starts with a stream header
+func IsStream(data []byte) bool {
+	return len(data) > 0 && data[0] == formatStream
+}
+
+type streamCipher struct {
+	aead   cipher.AEAD
+	prefix []byte
+	ad     []byte
+}
+
+func (s *streamCipher) nonce(i uint64, final bool) ([]byte, error) {
+	if i > math.MaxUint32 {
+		return nil, errors.New("stream too long")
+	}
+	res := make([]byte, s.aead.NonceSize())
+	copy(res, s.prefix)
+	binary.BigEndian.PutUint32(res[noncePrefixSize:], uint32(i))
+	if final {
+		res[len(res)-1] = 1
+	}
+	return res, nil
+}
+
+func (s *streamCipher) open(i uint64, final bool, data []byte) ([]byte, error) {
+	nonce, err := s.nonce(i, final)
+	if err != nil {
+		return nil, err
+	}
+	return s.aead.Open(nil, nonce, data, s.ad)
+}
+
+func (c *Crypter) streamCipher(id string, header []byte, b Binding) (*streamCipher, error) {
+	master, ok := c.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("can't decrypt: unknown key '%s'", id)
+	}
+	key, err := deriveKey(master, b.User)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &streamCipher{aead: aead, prefix: header[len(header)-noncePrefixSize:], ad: additionalData(header, b)}, nil
+}
+
+// readStreamHeader reads the header and prepares the cipher
+func (c *Crypter) readStreamHeader(r io.Reader, b Binding) (*streamCipher, int, error) {
+	start := make([]byte, 2)
+	if _, err := io.ReadFull(r, start); err != nil {
+		return nil, 0, fmt.Errorf("read header: %w", err)
+	}
+	if start[0] != formatStream || start[1] == 0 {
+		return nil, 0, errors.New("not a stream ciphertext")
+	}
+	header := make([]byte, 2+int(start[1])+noncePrefixSize)
+	copy(header, start)
+	if _, err := io.ReadFull(r, header[2:]); err != nil {
+		return nil, 0, fmt.Errorf("read header: %w", err)
+	}
+	res, err := c.streamCipher(string(header[2:2+int(start[1])]), header, b)
+	if err != nil {
+		return nil, 0, err
+	}
+	return res, len(header), nil
+}
+
+type streamWriter struct {
+	w       io.Writer
+	cipher  *streamCipher
+	buf     []byte
+	counter uint64
+	closed  bool
+}
+
+// NewStreamWriter encrypts data written to the result with the active key in segments.
+// Close must be called to write the final segment
+func (c *Crypter) NewStreamWriter(w io.Writer, b Binding) (io.WriteCloser, error) {
+	header := makeHeaderV(formatStream, c.active)
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return nil, err
+	}
+	header = append(header, prefix...)
+	sc, err := c.streamCipher(c.active, header, b)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &streamWriter{w: w, cipher: sc, buf: make([]byte, 0, StreamSegmentSize)}, nil
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	if s.closed {
+		return 0, errors.New("write to closed stream")
+	}
+	n := 0
+	for len(p) > 0 {
+		// flush only when more data comes, the last segment must be sealed as final on Close
+		if len(s.buf) == StreamSegmentSize {
+			if err := s.flush(false); err != nil {
+				return n, err
+			}
+		}
+		m := min(StreamSegmentSize-len(s.buf), len(p))
+		s.buf = append(s.buf, p[:m]...)
+		p = p[m:]
+		n += m
+	}
+	return n, nil
+}
+
+func (s *streamWriter) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.flush(true)
+}
+
+func (s *streamWriter) flush(final bool) error {
+	nonce, err := s.cipher.nonce(s.counter, final)
+	if err != nil {
+		return err
+	}
+	if _, err := s.w.Write(s.cipher.aead.Seal(nil, nonce, s.buf, s.cipher.ad)); err != nil {
+		return err
+	}
+	s.buf = s.buf[:0]
+	s.counter++
+	return nil
+}
+
+type streamReader struct {
+	r       *bufio.Reader
+	cipher  *streamCipher
+	in      []byte
+	out     []byte
+	counter uint64
+	done    bool
+}
+
+// NewStreamReader decrypts data written by NewStreamWriter
+func (c *Crypter) NewStreamReader(r io.Reader, b Binding) (io.Reader, error) {
+	sc, _, err := c.readStreamHeader(r, b)
+	if err != nil {
+		return nil, err
+	}
+	return &streamReader{r: bufio.NewReader(r), cipher: sc, in: make([]byte, StreamSegmentSize+sc.aead.Overhead())}, nil
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	for len(s.out) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		if err := s.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.out)
+	s.out = s.out[n:]
+	return n, nil
+}
+
+// next decrypts one segment, a full segment is the last one if no data follows it
+func (s *streamReader) next() error {
+	n, err := io.ReadFull(s.r, s.in)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return err
+	}
+	final := n < len(s.in)
+	if !final {
+		if _, err := s.r.Peek(1); err != nil {
+			if !errors.Is(err, io.EOF) {
+				return err
+			}
+			final = true
+		}
+	}
+	res, err := s.cipher.open(s.counter, final, s.in[:n])
+	if err != nil {
+		return fmt.Errorf("can't decrypt segment %d: %w", s.counter, err)
+	}
+	s.out = res
+	s.counter++
+	s.done = final
+	return nil
+}
+
+// StreamReaderAt decrypts a stream at random offsets, only the segments covering the range are read
+type StreamReaderAt struct {
+	ra       io.ReaderAt
+	cipher   *streamCipher
+	offset   int64
+	segments int64
+	lastLen  int64
+	size     int64
+
+	lock      sync.Mutex
+	cachedIdx int64
+	cached    []byte
+}
+
+// NewStreamReaderAt prepares random access decryption of a stream of the encrypted size.
+// Fails if the header or the first segment can't be authenticated
+func (c *Crypter) NewStreamReaderAt(ra io.ReaderAt, size int64, b Binding) (*StreamReaderAt, error) {
+	sc, hl, err := c.readStreamHeader(io.NewSectionReader(ra, 0, size), b)
+	if err != nil {
+		return nil, err
+	}
+	overhead := int64(sc.aead.Overhead())
+	full := int64(StreamSegmentSize) + overhead
+	body := size - int64(hl)
+	if body < overhead {
+		return nil, errors.New("stream too short")
+	}
+	segments := (body + full - 1) / full
+	lastLen := body - (segments-1)*full
+	if lastLen < overhead {
+		return nil, errors.New("wrong stream size")
+	}
+	res := &StreamReaderAt{ra: ra, cipher: sc, offset: int64(hl), segments: segments, lastLen: lastLen,
+		size: (segments-1)*StreamSegmentSize + lastLen - overhead, cachedIdx: -1}
+	// the first segment is authenticated at once, so data only looking like a stream fails here
+	if _, err := res.segment(0); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Size returns the size of decrypted data
+func (s *StreamReaderAt) Size() int64 {
+	return s.size
+}
+
+// ReadAt implements io.ReaderAt for decrypted data
+func (s *StreamReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	n := 0
+	for len(p) > 0 && off < s.size {
+		i := off / StreamSegmentSize
+		plain, err := s.segment(i)
+		if err != nil {
+			return n, err
+		}
+		m := copy(p, plain[off-i*StreamSegmentSize:])
+		p = p[m:]
+		n += m
+		off += int64(m)
+	}
+	if len(p) > 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (s *StreamReaderAt) segment(i int64) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.cachedIdx == i {
+		return s.cached, nil
+	}
+	final := i == s.segments-1
+	l := int64(StreamSegmentSize + s.cipher.aead.Overhead())
+	if final {
+		l = s.lastLen
+	}
+	buf := make([]byte, l)
+	n, err := s.ra.ReadAt(buf, s.offset+i*int64(StreamSegmentSize+s.cipher.aead.Overhead()))
+	if n < len(buf) {
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("read segment %d: %w", i, err)
+	}
+	res, err := s.cipher.open(uint64(i), final, buf)
+	if err != nil {
+		return nil, fmt.Errorf("can't decrypt segment %d: %w", i, err)
+	}
+	s.cachedIdx, s.cached = i, res
+	return res, nil
+}
+
+// EncryptStream encrypts data into the stream format
+func (c *Crypter) EncryptStream(data []byte, b Binding) ([]byte, error) {
+	res := &bytes.Buffer{}
+	w, err := c.NewStreamWriter(res, b)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return res.Bytes(), nil
+}
+
+// DecryptStream decrypts all stream data
+func (c *Crypter) DecryptStream(data []byte, b Binding) ([]byte, error) {
+	r, err := c.NewStreamReaderAt(bytes.NewReader(data), int64(len(data)), b)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]byte, r.Size())
+	if _, err := r.ReadAt(res, 0); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return res, nil
+}
+
+// ReencryptStream converts data in any supported format into a stream encrypted with the active key.
+// Returns false if the data is already up to date
+func (c *Crypter) ReencryptStream(data []byte, b Binding) ([]byte, bool, error) {
+	var plain []byte
+	var err error
+	var errStream error
+	if IsStream(data) {
+		if plain, errStream = c.DecryptStream(data, b); errStream == nil {
+			if id, _, _, ok := parseHeaderV(formatStream, data); ok && id == c.active {
+				return data, false, nil
+			}
+		}
+	}
+	// a legacy ciphertext starts with a random nonce, so it may look like a stream
+	if !IsStream(data) || errStream != nil {
+		if plain, err = c.DecryptFor(data, b); err != nil {
+			if errStream != nil {
+				err = errStream
+			}
+			return nil, false, err
+		}
+	}
+	res, err := c.EncryptStream(plain, b)
+	if err != nil {
+		return nil, false, err
+	}
+	return res, true, nil
+}
@@ -0,0 +1,179 @@
+package secure_test
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/airenas/rt-transcriber-wrapper/internal/secure"
+)
+
+func TestStream_EncryptDecrypt(t *testing.T) {
+	c, err := secure.NewCrypter([]byte("12345678901234567890123456789012"))
+	if err != nil {
+		t.Fatalf("NewCrypter() failed: %v", err)
+	}
+	b := secure.Binding{Type: "audio", User: "alice", Key: "audio:1"}
+	seg := secure.StreamSegmentSize
+	for _, size := range []int{0, 1, seg - 1, seg, seg + 1, 3 * seg, 3*seg + 100} {
+		data := make([]byte, size)
+		_, _ = rand.Read(data)
+
+		encrypted, err := c.EncryptStream(data, b)
+		if err != nil {
+			t.Fatalf("EncryptStream(%d) failed: %v", size, err)
+		}
+		if !secure.IsStream(encrypted) {
+			t.Errorf("IsStream(%d) = false", size)
+		}
+		r, err := c.NewStreamReader(bytes.NewReader(encrypted), b)
+		if err != nil {
+			t.Fatalf("NewStreamReader(%d) failed: %v", size, err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("read(%d) failed: %v", size, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("read(%d) returned wrong data", size)
+		}
+		got, err = c.DecryptStream(encrypted, b)
+		if err != nil {
+			t.Fatalf("DecryptStream(%d) failed: %v", size, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("DecryptStream(%d) returned wrong data", size)
+		}
+	}
+}
+
+func TestStreamReaderAt_Range(t *testing.T) {
+	c, _ := secure.NewCrypter([]byte("12345678901234567890123456789012"))
+	b := secure.Binding{Type: "audio", User: "alice", Key: "audio:1"}
+	data := make([]byte, 3*secure.StreamSegmentSize+10)
+	_, _ = rand.Read(data)
+	encrypted, err := c.EncryptStream(data, b)
+	if err != nil {
+		t.Fatalf("EncryptStream() failed: %v", err)
+	}
+	r, err := c.NewStreamReaderAt(bytes.NewReader(encrypted), int64(len(encrypted)), b)
+	if err != nil {
+		t.Fatalf("NewStreamReaderAt() failed: %v", err)
+	}
+	if r.Size() != int64(len(data)) {
+		t.Errorf("Size() = %d, want %d", r.Size(), len(data))
+	}
+	from := secure.StreamSegmentSize - 5
+	got := make([]byte, secure.StreamSegmentSize+10)
+	if _, err := r.ReadAt(got, int64(from)); err != nil {
+		t.Fatalf("ReadAt() failed: %v", err)
+	}
+	if !bytes.Equal(got, data[from:from+len(got)]) {
+		t.Errorf("ReadAt() returned wrong data")
+	}
+	n, err := r.ReadAt(got, int64(len(data)-3))
+	if n != 3 || err != io.EOF {
+		t.Errorf("ReadAt() at end = %d, %v, want 3, EOF", n, err)
+	}
+}
+
+func TestStream_Tampered(t *testing.T) {
+	c, _ := secure.NewCrypter([]byte("12345678901234567890123456789012"))
+	b := secure.Binding{Type: "audio", User: "alice", Key: "audio:1"}
+	data := make([]byte, 2*secure.StreamSegmentSize)
+	encrypted, err := c.EncryptStream(data, b)
+	if err != nil {
+		t.Fatalf("EncryptStream() failed: %v", err)
+	}
+	segment := secure.StreamSegmentSize + 16
+	tests := []struct {
+		name string
+		data []byte
+		b    secure.Binding
+	}{
+		{"truncated", encrypted[:len(encrypted)-segment], b},
+		{"cut", encrypted[:len(encrypted)-1], b},
+		{"other user", encrypted, secure.Binding{Type: "audio", User: "bob", Key: "audio:1"}},
+		{"other key", encrypted, secure.Binding{Type: "audio", User: "alice", Key: "audio:2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := c.DecryptStream(tt.data, tt.b); err == nil {
+				t.Errorf("DecryptStream() succeeded unexpectedly")
+			}
+			r, err := c.NewStreamReader(bytes.NewReader(tt.data), tt.b)
+			if err != nil {
+				return
+			}
+			if _, err := io.ReadAll(r); err == nil {
+				t.Errorf("read succeeded unexpectedly")
+			}
+		})
+	}
+}
+
+func TestReencryptStream(t *testing.T) {
+	k1, k2 := []byte("11111111111111111111111111111111"), []byte("22222222222222222222222222222222")
+	old, _ := secure.NewKeyring(map[string][]byte{"k1": k1}, "k1")
+	c, _ := secure.NewKeyring(map[string][]byte{"k1": k1, "k2": k2}, "k2")
+	b := secure.Binding{Type: "audio", User: "alice", Key: "audio:1"}
+	bound, _ := old.EncryptFor([]byte("wav"), b)
+	stream, _ := old.EncryptStream([]byte("wav"), b)
+	for name, data := range map[string][]byte{"bound": bound, "stream": stream} {
+		t.Run(name, func(t *testing.T) {
+			res, changed, err := c.ReencryptStream(data, b)
+			if err != nil || !changed {
+				t.Fatalf("ReencryptStream() = %v, %v, want changed", changed, err)
+			}
+			if _, changed, _ := c.ReencryptStream(res, b); changed {
+				t.Errorf("ReencryptStream() of current data changed = true")
+			}
+			got, err := c.DecryptStream(res, b)
+			if err != nil || string(got) != "wav" {
+				t.Errorf("DecryptStream() = %s, %v", got, err)
+			}
+		})
+	}
+}
+
+// legacyStreamLike seals data in the legacy headerless format with a nonce starting like a stream header
+func legacyStreamLike(t *testing.T, key, data []byte) []byte {
+	t.Helper()
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, _ = rand.Read(nonce)
+	nonce[0] = 3
+	return aead.Seal(nonce, nonce, data, nil)
+}
+
+func TestReencryptStream_legacyStreamLike(t *testing.T) {
+	k1 := []byte("11111111111111111111111111111111")
+	c, _ := secure.NewKeyring(map[string][]byte{"k1": k1}, "k1")
+	b := secure.Binding{Type: "audio", User: "alice", Key: "audio:1"}
+	data := legacyStreamLike(t, k1, []byte("wav"))
+	if !secure.IsStream(data) {
+		t.Fatal("IsStream() = false")
+	}
+	res, changed, err := c.ReencryptStream(data, b)
+	if err != nil || !changed {
+		t.Fatalf("ReencryptStream() = %v, %v, want changed", changed, err)
+	}
+	got, err := c.DecryptStream(res, b)
+	if err != nil || string(got) != "wav" {
+		t.Errorf("DecryptStream() = %s, %v", got, err)
+	}
+	data[len(data)-1] ^= 1
+	if _, _, err := c.ReencryptStream(data, b); err == nil {
+		t.Errorf("ReencryptStream() no error for tampered data")
+	}
+}
@@ -1,13 +1,16 @@
 package service
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -18,10 +21,12 @@ import (
 	"github.com/airenas/go-app/pkg/goapp"
 	"github.com/airenas/rt-transcriber-wrapper/internal/api"
 	"github.com/airenas/rt-transcriber-wrapper/internal/domain"
+	"github.com/airenas/rt-transcriber-wrapper/internal/export"
 
 	"github.com/labstack/echo-contrib/prometheus"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/oklog/ulid/v2"
 )
 
 type WSHandler interface {
@@ -29,7 +34,7 @@ type WSHandler interface {
 }
 
 type AudioManager interface {
-	GetAudio(ctx context.Context, id string) ([]byte, error)
+	OpenAudio(ctx context.Context, userID string, id string) (io.ReadSeeker, error)
 }
 
 type ConfigManager interface {
@@ -40,20 +45,45 @@ type ConfigManager interface {
 type TextManager interface {
 	GetTexts(ctx context.Context, userID string) (*domain.Texts, error)
 	SaveTexts(ctx context.Context, userID string, input *domain.Texts) error
+	UpdateTexts(ctx context.Context, userID string, update func(*domain.Texts) error) (*domain.Texts, error)
+}
+
+type TranscriptManager interface {
+	GetTranscript(ctx context.Context, userID string, id string) (*domain.Transcript, error)
+}
+
+type ExpiryManager interface {
+	GetExpiry(ctx context.Context, userID string) ([]*domain.Expiry, error)
+}
+
+type UsageManager interface {
+	GetUsage(ctx context.Context, userID string) (*domain.Usage, error)
+}
+
+type DictionaryManager interface {
+	GetDictionary(ctx context.Context, userID string) (*domain.Dictionary, error)
+	UpdateDictionary(ctx context.Context, userID string, update func(*domain.Dictionary) error) (*domain.Dictionary, error)
 }
 
 const userHeader = "User-Info"
 
 // Data keeps data required for service work
 type Data struct {
-	Port            int
-	DevMode         bool
-	WSHandlerStatus WSHandler
-	WSHandlerSpeech WSHandler
-	AudioManager    AudioManager
-	ConfigManager   ConfigManager
-	TextManager     TextManager
-	Ctx             context.Context
+	Port              int
+	DevMode           bool
+	WSHandlerStatus   WSHandler
+	WSHandlerSpeech   WSHandler
+	AudioManager      AudioManager
+	ConfigManager     ConfigManager
+	TextManager       TextManager
+	TranscriptManager TranscriptManager
+	ExpiryManager     ExpiryManager
+	UsageManager      UsageManager
+	DictionaryManager DictionaryManager
+	ExportOptions     export.Options
+	// Profiles are the pipeline profile names a user may select
+	Profiles []string
+	Ctx      context.Context
 }
 
 // StartWebServer starts echo web service
@@ -98,8 +128,9 @@ func initRoutes(data *Data) *echo.Echo {
 
 	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
 		AllowOrigins:     []string{"*"},
-		AllowMethods:     []string{echo.GET, echo.POST, echo.OPTIONS},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization", userHeader},
+		AllowMethods:     []string{echo.GET, echo.POST, echo.PUT, echo.DELETE, echo.OPTIONS},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization", "Range", userHeader},
+		ExposeHeaders:    []string{"Content-Range", "Accept-Ranges", "Content-Length"},
 		AllowCredentials: true,
 	}))
 
@@ -111,6 +142,19 @@ func initRoutes(data *Data) *echo.Echo {
 	e.POST("/client/config", configSaveHandler(data))
 	e.GET("/client/text", txtHandler(data))
 	e.POST("/client/text", txtSaveHandler(data))
+	e.POST("/client/text/parts", partAddHandler(data))
+	e.PUT("/client/text/parts/:id", partUpdateHandler(data))
+	e.DELETE("/client/text/parts/:id", partDeleteHandler(data))
+	e.PUT("/client/text/order", partsOrderHandler(data))
+	e.GET("/client/transcripts/:id", transcriptHandler(data))
+	e.GET("/client/transcripts/:id/export", transcriptExportHandler(data))
+	e.GET("/client/expiry", expiryHandler(data))
+	e.GET("/client/usage", usageHandler(data))
+	e.GET("/client/dictionary", dictionaryHandler(data))
+	e.PUT("/client/dictionary", dictionarySaveHandler(data))
+	e.POST("/client/dictionary/rules", ruleAddHandler(data))
+	e.PUT("/client/dictionary/rules/:id", ruleUpdateHandler(data))
+	e.DELETE("/client/dictionary/rules/:id", ruleDeleteHandler(data))
 
 	goapp.Log.Info().Msg("Routes:")
 	for _, r := range e.Routes() {
@@ -141,6 +185,18 @@ func validate(data *Data) error {
 	if data.TextManager == nil {
 		return fmt.Errorf("no TextManager")
 	}
+	if data.TranscriptManager == nil {
+		return fmt.Errorf("no TranscriptManager")
+	}
+	if data.ExpiryManager == nil {
+		return fmt.Errorf("no ExpiryManager")
+	}
+	if data.UsageManager == nil {
+		return fmt.Errorf("no UsageManager")
+	}
+	if data.DictionaryManager == nil {
+		return fmt.Errorf("no DictionaryManager")
+	}
 	return nil
 }
 
@@ -181,14 +237,17 @@ func audioHandler(data *Data) echo.HandlerFunc {
 		}
 		goapp.Log.Info().Str("id", id).Str("user", user.ID).Msg("Getting audio")
 
-		finalId := fmt.Sprintf("audio-%s-%s", user.ID, id)
-
-		data, err := data.AudioManager.GetAudio(c.Request().Context(), finalId)
+		audio, err := data.AudioManager.OpenAudio(c.Request().Context(), user.ID, id)
 		if err != nil {
+			if !errors.Is(err, domain.ErrNotFound) {
+				goapp.Log.Error().Err(err).Msg("can't open audio")
+			}
 			return c.String(http.StatusNotFound, "audio not found")
 		}
 
-		return c.Blob(http.StatusOK, "audio/wav", data)
+		c.Response().Header().Set(echo.HeaderContentType, "audio/wav")
+		http.ServeContent(c.Response(), c.Request(), id+".wav", time.Time{}, audio)
+		return nil
 	}
 }
 
@@ -206,6 +265,8 @@ func configHandler(data *Data) echo.HandlerFunc {
 		}
 		res := api.Config{
 			SkipTour: data.SkipTour,
+			Profile:  data.Profile,
+			Masking:  data.Masking,
 		}
 
 		return c.JSON(http.StatusOK, res)
@@ -219,16 +280,30 @@ func configSaveHandler(data *Data) echo.HandlerFunc {
 			return c.String(http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
 		}
 		goapp.Log.Info().Str("id", user.ID).Msg("Save config")
-		var input api.Config
+		var input api.ConfigUpdate
 		if err := c.Bind(&input); err != nil {
 			return c.String(http.StatusBadRequest, "invalid input")
 		}
+		if input.Profile != nil && *input.Profile != "" && !slices.Contains(data.Profiles, *input.Profile) {
+			return c.String(http.StatusBadRequest, "unknown profile")
+		}
 
-		err = data.ConfigManager.SaveConfig(c.Request().Context(), &domain.User{
-			ID:       user.ID,
-			SkipTour: input.SkipTour,
-		})
+		stored, err := data.ConfigManager.GetConfig(c.Request().Context(), user.ID)
 		if err != nil {
+			goapp.Log.Error().Err(err).Msg("can't get config")
+			return c.String(http.StatusInternalServerError, "failed to save config")
+		}
+		stored.ID = user.ID
+		if input.SkipTour != nil {
+			stored.SkipTour = *input.SkipTour
+		}
+		if input.Profile != nil {
+			stored.Profile = *input.Profile
+		}
+		if input.Masking != nil {
+			stored.Masking = input.Masking
+		}
+		if err := data.ConfigManager.SaveConfig(c.Request().Context(), stored); err != nil {
 			goapp.Log.Error().Err(err).Msg("can't save config")
 			return c.String(http.StatusInternalServerError, "failed to save config")
 		}
@@ -251,6 +326,9 @@ func txtSaveHandler(data *Data) echo.HandlerFunc {
 
 		inData := mapToTexts(&input)
 		if err = data.TextManager.SaveTexts(c.Request().Context(), user.ID, inData); err != nil {
+			if errors.Is(err, domain.ErrQuotaExceeded) {
+				return c.String(http.StatusRequestEntityTooLarge, "quota exceeded")
+			}
 			goapp.Log.Error().Err(err).Msg("can't save texts")
 			return c.String(http.StatusInternalServerError, "failed to save texts")
 		}
@@ -299,6 +377,358 @@ func mapFromTexts(texts *domain.Texts) *api.Texts {
 	return res
 }
 
+func partAddHandler(data *Data) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, err := extractUserFromHeader(c.Request().Header)
+		if err != nil {
+			return c.String(http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+		}
+		var input api.Part
+		if err := c.Bind(&input); err != nil {
+			return c.String(http.StatusBadRequest, "invalid input")
+		}
+		if strings.TrimSpace(input.ID) == "" {
+			input.ID = ulid.Make().String()
+		}
+		goapp.Log.Info().Str("id", user.ID).Str("part", input.ID).Msg("add part")
+		_, err = data.TextManager.UpdateTexts(c.Request().Context(), user.ID, func(t *domain.Texts) error {
+			return t.Append(domain.Part{ID: input.ID, Text: input.Text})
+		})
+		if err != nil {
+			return partErrorResponse(c, err)
+		}
+		return c.JSON(http.StatusOK, input)
+	}
+}
+
+func partUpdateHandler(data *Data) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, err := extractUserFromHeader(c.Request().Header)
+		if err != nil {
+			return c.String(http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+		}
+		var input api.Part
+		if err := c.Bind(&input); err != nil {
+			return c.String(http.StatusBadRequest, "invalid input")
+		}
+		input.ID = c.Param("id")
+		goapp.Log.Info().Str("id", user.ID).Str("part", input.ID).Msg("update part")
+		_, err = data.TextManager.UpdateTexts(c.Request().Context(), user.ID, func(t *domain.Texts) error {
+			return t.Update(domain.Part{ID: input.ID, Text: input.Text})
+		})
+		if err != nil {
+			return partErrorResponse(c, err)
+		}
+		return c.JSON(http.StatusOK, input)
+	}
+}
+
+func partDeleteHandler(data *Data) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, err := extractUserFromHeader(c.Request().Header)
+		if err != nil {
+			return c.String(http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+		}
+		id := c.Param("id")
+		goapp.Log.Info().Str("id", user.ID).Str("part", id).Msg("delete part")
+		_, err = data.TextManager.UpdateTexts(c.Request().Context(), user.ID, func(t *domain.Texts) error {
+			return t.Delete(id)
+		})
+		if err != nil {
+			return partErrorResponse(c, err)
+		}
+		return c.String(http.StatusOK, "ok")
+	}
+}
+
+func partsOrderHandler(data *Data) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, err := extractUserFromHeader(c.Request().Header)
+		if err != nil {
+			return c.String(http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+		}
+		var input api.Order
+		if err := c.Bind(&input); err != nil {
+			return c.String(http.StatusBadRequest, "invalid input")
+		}
+		goapp.Log.Info().Str("id", user.ID).Int("len", len(input.IDs)).Msg("reorder parts")
+		texts, err := data.TextManager.UpdateTexts(c.Request().Context(), user.ID, func(t *domain.Texts) error {
+			return t.Reorder(input.IDs)
+		})
+		if err != nil {
+			return partErrorResponse(c, err)
+		}
+		return c.JSON(http.StatusOK, mapFromTexts(texts))
+	}
+}
+
+func partErrorResponse(c echo.Context, err error) error {
+	switch {
+	case errors.Is(err, domain.ErrPartNotFound):
+		return c.String(http.StatusNotFound, "part not found")
+	case errors.Is(err, domain.ErrPartExists):
+		return c.String(http.StatusConflict, "part already exists")
+	case errors.Is(err, domain.ErrWrongOrder):
+		return c.String(http.StatusBadRequest, "wrong order")
+	case errors.Is(err, domain.ErrQuotaExceeded):
+		return c.String(http.StatusRequestEntityTooLarge, "quota exceeded")
+	}
+	goapp.Log.Error().Err(err).Msg("can't update texts")
+	return c.String(http.StatusInternalServerError, "failed to update texts")
+}
+
+func transcriptHandler(data *Data) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id := c.Param("id")
+		user, err := extractUserFromHeader(c.Request().Header)
+		if err != nil {
+			return c.String(http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+		}
+		goapp.Log.Info().Str("id", id).Str("user", user.ID).Msg("Getting transcript")
+		transcript, err := data.TranscriptManager.GetTranscript(c.Request().Context(), user.ID, id)
+		if err != nil {
+			if errors.Is(err, domain.ErrNotFound) {
+				return c.String(http.StatusNotFound, "transcript not found")
+			}
+			goapp.Log.Error().Err(err).Msg("can't get transcript")
+			return c.String(http.StatusInternalServerError, "failed to get transcript")
+		}
+		return c.JSON(http.StatusOK, mapFromTranscript(transcript))
+	}
+}
+
+func transcriptExportHandler(data *Data) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id := c.Param("id")
+		user, err := extractUserFromHeader(c.Request().Header)
+		if err != nil {
+			return c.String(http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+		}
+		format := strings.ToLower(c.QueryParam("format"))
+		if format == "" {
+			format = export.FormatTxt
+		}
+		switch format {
+		case export.FormatSRT, export.FormatVTT, export.FormatTxt, export.FormatJSON:
+		default:
+			return c.String(http.StatusBadRequest, "unsupported format")
+		}
+		goapp.Log.Info().Str("id", id).Str("user", user.ID).Str("format", format).Msg("Export transcript")
+		transcript, err := data.TranscriptManager.GetTranscript(c.Request().Context(), user.ID, id)
+		if err != nil {
+			if errors.Is(err, domain.ErrNotFound) {
+				return c.String(http.StatusNotFound, "transcript not found")
+			}
+			goapp.Log.Error().Err(err).Msg("can't get transcript")
+			return c.String(http.StatusInternalServerError, "failed to get transcript")
+		}
+		c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", id+"."+format))
+		if format == export.FormatJSON {
+			return c.JSON(http.StatusOK, mapFromTranscript(transcript))
+		}
+		b := &bytes.Buffer{}
+		if err := export.Write(b, format, transcript, data.ExportOptions); err != nil {
+			goapp.Log.Error().Err(err).Msg("can't export transcript")
+			return c.String(http.StatusInternalServerError, "failed to export transcript")
+		}
+		return c.Blob(http.StatusOK, export.ContentType(format), b.Bytes())
+	}
+}
+
+func mapFromTranscript(transcript *domain.Transcript) *api.Transcript {
+	res := &api.Transcript{
+		ID:      transcript.ID,
+		Created: transcript.Created,
+		Updated: transcript.Updated,
+		Text:    transcript.Text(),
+	}
+	for _, s := range transcript.Segments {
+		segment := api.TranscriptSegment{Segment: s.Segment, Start: s.Start, Length: s.Length, Text: s.Text}
+		for _, w := range s.Words {
+			segment.Words = append(segment.Words, api.WordAlignment{Start: w.Start, Length: w.Length, Word: w.Word, Confidence: w.Confidence})
+		}
+		res.Segments = append(res.Segments, segment)
+	}
+	return res
+}
+
+func expiryHandler(data *Data) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, err := extractUserFromHeader(c.Request().Header)
+		if err != nil {
+			return c.String(http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+		}
+		goapp.Log.Debug().Str("id", user.ID).Msg("Getting expiry")
+		items, err := data.ExpiryManager.GetExpiry(c.Request().Context(), user.ID)
+		if err != nil {
+			goapp.Log.Error().Err(err).Msg("can't get expiry")
+			return c.String(http.StatusInternalServerError, "failed to get expiry")
+		}
+		res := &api.Expiries{Items: []api.Expiry{}}
+		for _, it := range items {
+			res.Items = append(res.Items, api.Expiry{Type: it.Type, ID: it.ID, ExpiresAt: it.ExpiresAt, Sliding: it.Sliding})
+		}
+		return c.JSON(http.StatusOK, res)
+	}
+}
+
+func usageHandler(data *Data) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, err := extractUserFromHeader(c.Request().Header)
+		if err != nil {
+			return c.String(http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+		}
+		goapp.Log.Debug().Str("id", user.ID).Msg("Getting usage")
+		usage, err := data.UsageManager.GetUsage(c.Request().Context(), user.ID)
+		if err != nil {
+			goapp.Log.Error().Err(err).Msg("can't get usage")
+			return c.String(http.StatusInternalServerError, "failed to get usage")
+		}
+		return c.JSON(http.StatusOK, &api.Usage{Used: mapFromQuota(usage.Used), Limit: mapFromQuota(usage.Limit)})
+	}
+}
+
+func mapFromQuota(q domain.Quota) api.UsageAmount {
+	return api.UsageAmount{AudioBytes: q.AudioBytes, Recordings: q.Recordings, TextBytes: q.TextBytes}
+}
+
+func dictionaryHandler(data *Data) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, err := extractUserFromHeader(c.Request().Header)
+		if err != nil {
+			return c.String(http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+		}
+		goapp.Log.Info().Str("id", user.ID).Msg("Getting dictionary")
+		dict, err := data.DictionaryManager.GetDictionary(c.Request().Context(), user.ID)
+		if err != nil {
+			goapp.Log.Error().Err(err).Msg("can't get dictionary")
+			return c.String(http.StatusInternalServerError, "failed to get dictionary")
+		}
+		return c.JSON(http.StatusOK, mapFromDictionary(dict))
+	}
+}
+
+func dictionarySaveHandler(data *Data) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, err := extractUserFromHeader(c.Request().Header)
+		if err != nil {
+			return c.String(http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+		}
+		var input api.Dictionary
+		if err := c.Bind(&input); err != nil {
+			return c.String(http.StatusBadRequest, "invalid input")
+		}
+		goapp.Log.Info().Str("id", user.ID).Int("len", len(input.Rules)).Msg("save dictionary")
+		dict, err := data.DictionaryManager.UpdateDictionary(c.Request().Context(), user.ID, func(d *domain.Dictionary) error {
+			res := &domain.Dictionary{}
+			for _, r := range input.Rules {
+				if strings.TrimSpace(r.ID) == "" {
+					r.ID = ulid.Make().String()
+				}
+				res.Rules = append(res.Rules, mapToRule(&r))
+			}
+			if err := res.Validate(); err != nil {
+				return err
+			}
+			*d = *res
+			return nil
+		})
+		if err != nil {
+			return ruleErrorResponse(c, err)
+		}
+		return c.JSON(http.StatusOK, mapFromDictionary(dict))
+	}
+}
+
+func ruleAddHandler(data *Data) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, err := extractUserFromHeader(c.Request().Header)
+		if err != nil {
+			return c.String(http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+		}
+		var input api.DictionaryRule
+		if err := c.Bind(&input); err != nil {
+			return c.String(http.StatusBadRequest, "invalid input")
+		}
+		if strings.TrimSpace(input.ID) == "" {
+			input.ID = ulid.Make().String()
+		}
+		goapp.Log.Info().Str("id", user.ID).Str("rule", input.ID).Msg("add rule")
+		_, err = data.DictionaryManager.UpdateDictionary(c.Request().Context(), user.ID, func(d *domain.Dictionary) error {
+			return d.Add(mapToRule(&input))
+		})
+		if err != nil {
+			return ruleErrorResponse(c, err)
+		}
+		return c.JSON(http.StatusOK, input)
+	}
+}
+
+func ruleUpdateHandler(data *Data) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, err := extractUserFromHeader(c.Request().Header)
+		if err != nil {
+			return c.String(http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+		}
+		var input api.DictionaryRule
+		if err := c.Bind(&input); err != nil {
+			return c.String(http.StatusBadRequest, "invalid input")
+		}
+		input.ID = c.Param("id")
+		goapp.Log.Info().Str("id", user.ID).Str("rule", input.ID).Msg("update rule")
+		_, err = data.DictionaryManager.UpdateDictionary(c.Request().Context(), user.ID, func(d *domain.Dictionary) error {
+			return d.Update(mapToRule(&input))
+		})
+		if err != nil {
+			return ruleErrorResponse(c, err)
+		}
+		return c.JSON(http.StatusOK, input)
+	}
+}
+
+func ruleDeleteHandler(data *Data) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, err := extractUserFromHeader(c.Request().Header)
+		if err != nil {
+			return c.String(http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+		}
+		id := c.Param("id")
+		goapp.Log.Info().Str("id", user.ID).Str("rule", id).Msg("delete rule")
+		_, err = data.DictionaryManager.UpdateDictionary(c.Request().Context(), user.ID, func(d *domain.Dictionary) error {
+			return d.Delete(id)
+		})
+		if err != nil {
+			return ruleErrorResponse(c, err)
+		}
+		return c.String(http.StatusOK, "ok")
+	}
+}
+
+func ruleErrorResponse(c echo.Context, err error) error {
+	switch {
+	case errors.Is(err, domain.ErrRuleNotFound):
+		return c.String(http.StatusNotFound, "rule not found")
+	case errors.Is(err, domain.ErrRuleExists):
+		return c.String(http.StatusConflict, "rule already exists")
+	case errors.Is(err, domain.ErrWrongRule):
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	goapp.Log.Error().Err(err).Msg("can't update dictionary")
+	return c.String(http.StatusInternalServerError, "failed to update dictionary")
+}
+
+func mapToRule(r *api.DictionaryRule) domain.DictionaryRule {
+	return domain.DictionaryRule{ID: r.ID, From: r.From, To: r.To, Regex: r.Regex, PreserveCase: r.PreserveCase}
+}
+
+func mapFromDictionary(d *domain.Dictionary) *api.Dictionary {
+	res := &api.Dictionary{Rules: []api.DictionaryRule{}}
+	for _, r := range d.Rules {
+		res.Rules = append(res.Rules, api.DictionaryRule{ID: r.ID, From: r.From, To: r.To, Regex: r.Regex, PreserveCase: r.PreserveCase})
+	}
+	return res
+}
+
 type user struct {
 	ID string `json:"id"`
 }
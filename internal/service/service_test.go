@@ -1,8 +1,22 @@
 package service
 
 import (
+	"context"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/airenas/rt-transcriber-wrapper/internal/api"
+	"github.com/airenas/rt-transcriber-wrapper/internal/db"
+	"github.com/airenas/rt-transcriber-wrapper/internal/domain"
+	"github.com/airenas/rt-transcriber-wrapper/internal/handlers"
+	"github.com/labstack/echo/v4"
 )
 
 func Test_extractUserTxt(t *testing.T) {
@@ -50,3 +64,165 @@ func Test_extractUserTxt(t *testing.T) {
 		})
 	}
 }
+
+type testConfigGetter struct {
+	profile string
+}
+
+func (g *testConfigGetter) GetConfig(_ context.Context, userID string) (*domain.User, error) {
+	return &domain.User{ID: userID, Profile: g.profile}, nil
+}
+
+type testHandler struct {
+	name string
+}
+
+func (h *testHandler) Process(_ context.Context, _ *handlers.SessionState, data *api.FullResult) (*api.FullResult, error) {
+	return data, nil
+}
+
+func TestWSTranscriptionHandler_selectProfile(t *testing.T) {
+	def, raw := &testHandler{name: "default"}, &testHandler{name: "raw"}
+	tests := []struct {
+		name      string
+		query     string
+		user      string
+		want      string
+		wantQuery string
+	}{
+		{name: "default", query: "a=1", want: DefaultProfile, wantQuery: "a=1"},
+		{name: "query", query: "a=1&profile=raw", want: "raw", wantQuery: "a=1"},
+		{name: "user", query: "a=1", user: "raw", want: "raw", wantQuery: "a=1"},
+		{name: "query over user", query: "profile=default", user: "raw", want: DefaultProfile, wantQuery: ""},
+		{name: "not whitelisted", query: "profile=other", want: DefaultProfile, wantQuery: ""},
+		{name: "raw query kept", query: "z=1&profile=raw&a=%7e+b&c", want: "raw", wantQuery: "z=1&a=%7e+b&c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kp := NewWSTranscriptionHandler("ws://localhost", nil, nil, &testConfigGetter{profile: tt.user})
+			kp.Middleware = def
+			kp.Profiles = map[string]Handler{"raw": raw}
+			u, _ := url.Parse("ws://localhost/speech?" + tt.query)
+			got, h, query := kp.selectProfile(context.Background(), u, "u1")
+			if got != tt.want || h.(*testHandler).name != tt.want {
+				t.Errorf("selectProfile() = %v, %v, want %v", got, h, tt.want)
+			}
+			if query != tt.wantQuery {
+				t.Errorf("selectProfile() query = %v, want %v", query, tt.wantQuery)
+			}
+		})
+	}
+}
+
+type testConfigManager map[string]*domain.User
+
+func (m testConfigManager) GetConfig(_ context.Context, userID string) (*domain.User, error) {
+	if res, ok := m[userID]; ok {
+		c := *res
+		return &c, nil
+	}
+	return &domain.User{ID: userID}, nil
+}
+
+func (m testConfigManager) SaveConfig(_ context.Context, user *domain.User) error {
+	m[user.ID] = user
+	return nil
+}
+
+func Test_configSaveHandler(t *testing.T) {
+	on := true
+	tests := []struct {
+		name     string
+		body     string
+		wantCode int
+		want     domain.User
+	}{
+		{name: "partial", body: `{"skipTour":true}`, wantCode: http.StatusOK,
+			want: domain.User{ID: "u1", SkipTour: true, Profile: "raw", Masking: &on}},
+		{name: "profile", body: `{"profile":""}`, wantCode: http.StatusOK, want: domain.User{ID: "u1", Masking: &on}},
+		{name: "masking", body: `{"masking":false}`, wantCode: http.StatusOK,
+			want: domain.User{ID: "u1", Profile: "raw", Masking: new(bool)}},
+		{name: "unknown profile", body: `{"profile":"other"}`, wantCode: http.StatusBadRequest,
+			want: domain.User{ID: "u1", Profile: "raw", Masking: &on}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configs := testConfigManager{"u1": {ID: "u1", Profile: "raw", Masking: &on}}
+			data := &Data{ConfigManager: configs, Profiles: []string{DefaultProfile, "raw"}}
+			req := httptest.NewRequest(http.MethodPost, "/client/config", strings.NewReader(tt.body))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			req.Header.Set(userHeader, base64.StdEncoding.EncodeToString([]byte(`{"id":"u1"}`)))
+			rec := httptest.NewRecorder()
+			if err := configSaveHandler(data)(echo.New().NewContext(req, rec)); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != tt.wantCode {
+				t.Errorf("configSaveHandler() code = %d, want %d", rec.Code, tt.wantCode)
+			}
+			if got := configs["u1"]; !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("configSaveHandler() saved = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+type failingTranscripts struct{}
+
+func (failingTranscripts) GetTranscript(context.Context, string, string) (*domain.Transcript, error) {
+	return nil, errors.New("fail")
+}
+
+func Test_transcriptHandler(t *testing.T) {
+	memory := db.NewMemoryDataManager()
+	session := handlers.NewRecordSession(nil, memory, "u1", "", func(*api.FullResult) error { return nil })
+	session.Start(false)
+	pipeline, _ := handlers.NewListHandler()
+	for i, text := range []string{"labas", "rytas"} {
+		final := &api.FullResult{Segment: i, Result: api.Result{Final: true, Hypotheses: []api.Hypothesis{{Transcript: text}}}}
+		if _, err := session.Process(context.Background(), final, pipeline); err != nil {
+			t.Fatal(err)
+		}
+	}
+	session.Close()
+	id := session.Transcription.ID
+
+	tests := []struct {
+		name     string
+		manager  TranscriptManager
+		user     string
+		id       string
+		wantCode int
+		wantText string
+	}{
+		{name: "saved", manager: memory, user: "u1", id: id, wantCode: http.StatusOK, wantText: "labas rytas"},
+		{name: "other user", manager: memory, user: "u2", id: id, wantCode: http.StatusNotFound},
+		{name: "not found", manager: memory, user: "u1", id: "other", wantCode: http.StatusNotFound},
+		{name: "error", manager: failingTranscripts{}, user: "u1", id: id, wantCode: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/client/transcripts/"+tt.id, nil)
+			req.Header.Set(userHeader, base64.StdEncoding.EncodeToString([]byte(`{"id":"`+tt.user+`"}`)))
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(req, rec)
+			c.SetParamNames("id")
+			c.SetParamValues(tt.id)
+			if err := transcriptHandler(&Data{TranscriptManager: tt.manager})(c); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != tt.wantCode {
+				t.Fatalf("transcriptHandler() code = %d, want %d", rec.Code, tt.wantCode)
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			var got api.Transcript
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.ID != tt.id || got.Text != tt.wantText || len(got.Segments) != 2 {
+				t.Errorf("transcriptHandler() = %+v, want %q", got, tt.wantText)
+			}
+		})
+	}
+}
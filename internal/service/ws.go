@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/airenas/go-app/pkg/goapp"
@@ -15,10 +16,27 @@ type data struct {
 	msg []byte
 }
 
+type wsConn interface {
+	ReadMessage() (messageType int, p []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+}
+
+// lockedConn serializes writes, a websocket connection supports only one concurrent writer
+type lockedConn struct {
+	*websocket.Conn
+	lock sync.Mutex
+}
+
+func (c *lockedConn) WriteMessage(messageType int, data []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.Conn.WriteMessage(messageType, data)
+}
+
 type proxyData struct {
-	in          *websocket.Conn
+	in          wsConn
 	closeCtx    context.Context
-	out         *websocket.Conn
+	out         wsConn
 	forward     bool
 	closeFunc   func()
 	processFunc func(ctx context.Context, input *data) (out []*data, in []*data, err error)
@@ -68,7 +86,7 @@ loop:
 	}
 }
 
-func readWebSocket(ctx context.Context, in *websocket.Conn) <-chan data {
+func readWebSocket(ctx context.Context, in wsConn) <-chan data {
 	resCh := make(chan data)
 	go func() {
 		defer close(resCh)
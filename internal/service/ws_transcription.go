@@ -4,13 +4,17 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/airenas/go-app/pkg/goapp"
 	"github.com/airenas/rt-transcriber-wrapper/internal/api"
+	"github.com/airenas/rt-transcriber-wrapper/internal/domain"
 	"github.com/airenas/rt-transcriber-wrapper/internal/handlers"
 	"github.com/gorilla/websocket"
 )
@@ -22,15 +26,26 @@ type WsConn interface {
 }
 
 type Handler interface {
-	Process(context.Context, *api.FullResult) (*api.FullResult, error)
+	Process(context.Context, *handlers.SessionState, *api.FullResult) (*api.FullResult, error)
 }
 
+// ProfileParam is the query parameter selecting the pipeline profile
+const ProfileParam = "profile"
+
+// DefaultProfile is the name of the Middleware pipeline
+const DefaultProfile = "default"
+
 // WSTranscriptionHandler implements connection management
 type WSTranscriptionHandler struct {
 	timeOut    time.Duration
 	backendURL string
+	// Middleware is the default pipeline
 	Middleware Handler
-	audioSaver AudioSaver
+	// Profiles are additional pipelines selectable by the query parameter or the user config
+	Profiles        map[string]Handler
+	audioSaver      AudioSaver
+	transcriptSaver handlers.TranscriptSaver
+	configGetter    ConfigGetter
 }
 
 // type ConnState struct {
@@ -39,15 +54,21 @@ type WSTranscriptionHandler struct {
 // }
 
 type AudioSaver interface {
-	SaveAudio(ctx context.Context, id string, data [][]byte) error
+	SaveAudio(ctx context.Context, userID string, id string, data [][]byte) error
+}
+
+type ConfigGetter interface {
+	GetConfig(ctx context.Context, userID string) (*domain.User, error)
 }
 
 // NewWSTranscriptionHandler creates handler
-func NewWSTranscriptionHandler(url string, audioSaver AudioSaver) *WSTranscriptionHandler {
+func NewWSTranscriptionHandler(url string, audioSaver AudioSaver, transcriptSaver handlers.TranscriptSaver, configGetter ConfigGetter) *WSTranscriptionHandler {
 	res := &WSTranscriptionHandler{}
 	res.timeOut = time.Minute * 5
 	res.backendURL = url
 	res.audioSaver = audioSaver
+	res.transcriptSaver = transcriptSaver
+	res.configGetter = configGetter
 	goapp.Log.Info().Str("be url", url).Send()
 	return res
 }
@@ -56,6 +77,8 @@ func NewWSTranscriptionHandler(url string, audioSaver AudioSaver) *WSTranscripti
 func (kp *WSTranscriptionHandler) HandleConnection(ctx context.Context, conn *websocket.Conn, req *http.Request, userID string) error {
 	query := req.URL.RawQuery
 	goapp.Log.Info().Str("query", query).Msg("got")
+	profile, middleware, query := kp.selectProfile(ctx, req.URL, userID)
+	goapp.Log.Info().Str("profile", profile).Str("user", userID).Msg("pipeline")
 
 	defer conn.Close()
 	url := kp.backendURL
@@ -72,15 +95,17 @@ func (kp *WSTranscriptionHandler) HandleConnection(ctx context.Context, conn *we
 	closeCtx, cf := context.WithCancel(ctx)
 	defer cf()
 	wg := &sync.WaitGroup{}
+	client := &lockedConn{Conn: conn}
 
 	writeFunc := func(res *api.FullResult) error {
 		msg, err := encode(res)
 		if err != nil {
 			return err
 		}
-		return conn.WriteMessage(websocket.TextMessage, []byte(msg))
+		return client.WriteMessage(websocket.TextMessage, []byte(msg))
 	}
-	session := handlers.NewRecordSession(kp.audioSaver, userID, writeFunc)
+	session := handlers.NewRecordSession(kp.audioSaver, kp.transcriptSaver, userID, profile, writeFunc)
+	defer session.Close()
 
 	wg.Add(2)
 
@@ -102,7 +127,7 @@ func (kp *WSTranscriptionHandler) HandleConnection(ctx context.Context, conn *we
 		if inp == api.EventStart || inp == api.EventStartAuto {
 			session.Start(inp == api.EventStartAuto)
 			res := &api.FullResult{
-				Event: api.EventStart, TranscriptionID: session.Transcription.ID,
+				Event: api.EventStart, TranscriptionID: session.Transcription.ID, Profile: profile,
 			}
 			msg, err := encode(res)
 			if err != nil {
@@ -134,7 +159,11 @@ func (kp *WSTranscriptionHandler) HandleConnection(ctx context.Context, conn *we
 			return out, in, nil
 		}
 
-		inpMsgs, err := session.Process(_ctx, inpData, kp.Middleware)
+		inpMsgs, err := session.Process(_ctx, inpData, middleware)
+		if errors.Is(err, handlers.ErrStageFailed) {
+			goapp.Log.Warn().Err(err).Int("segment", inpData.Segment).Msg("drop result")
+			return out, in, nil
+		}
 		if err != nil {
 			goapp.Log.Error().Err(err).Msg("session err")
 			out = append(out, input)
@@ -153,7 +182,7 @@ func (kp *WSTranscriptionHandler) HandleConnection(ctx context.Context, conn *we
 	}
 
 	go proxyFunc(ctx, &proxyData{
-		in:          conn,
+		in:          client,
 		out:         c,
 		forward:     true,
 		closeCtx:    closeCtx,
@@ -163,7 +192,7 @@ func (kp *WSTranscriptionHandler) HandleConnection(ctx context.Context, conn *we
 
 	go proxyFunc(ctx, &proxyData{
 		in:          c,
-		out:         conn,
+		out:         client,
 		forward:     false,
 		closeCtx:    closeCtx,
 		closeFunc:   closeFunc,
@@ -179,6 +208,47 @@ func (kp *WSTranscriptionHandler) HandleConnection(ctx context.Context, conn *we
 	return nil
 }
 
+// selectProfile picks the pipeline from the query parameter, then from the user config.
+// Only configured profile names are accepted. The parameter is removed from the query passed to the backend
+func (kp *WSTranscriptionHandler) selectProfile(ctx context.Context, u *url.URL, userID string) (string, Handler, string) {
+	query := u.RawQuery
+	name := ""
+	if values := u.Query(); values.Has(ProfileParam) {
+		name = values.Get(ProfileParam)
+		query = removeParam(query, ProfileParam)
+	}
+	if name == "" && kp.configGetter != nil {
+		user, err := kp.configGetter.GetConfig(ctx, userID)
+		if err != nil {
+			goapp.Log.Error().Err(err).Msg("can't get user config")
+		} else {
+			name = user.Profile
+		}
+	}
+	if name == "" || name == DefaultProfile {
+		return DefaultProfile, kp.Middleware, query
+	}
+	if h, ok := kp.Profiles[name]; ok {
+		return name, h, query
+	}
+	goapp.Log.Warn().Str("profile", name).Msg("unknown profile, using default")
+	return DefaultProfile, kp.Middleware, query
+}
+
+// removeParam drops the parameter from the raw query keeping other parameters as they were sent
+func removeParam(query, name string) string {
+	parts := strings.Split(query, "&")
+	res := parts[:0]
+	for _, p := range parts {
+		key, _, _ := strings.Cut(p, "=")
+		if k, err := url.QueryUnescape(key); err == nil && k == name {
+			continue
+		}
+		res = append(res, p)
+	}
+	return strings.Join(res, "&")
+}
+
 func decode(data string) (*api.FullResult, error) {
 	res := &api.FullResult{}
 	err := json.NewDecoder(bytes.NewBufferString(data)).Decode(&res)
@@ -0,0 +1,45 @@
+package utils
+
+type ProcessData struct {
+	Original   string
+	Punctuated string
+}
+
+type Segments struct {
+	Final       bool
+	ID          int
+	OriginalStr string
+	Processed   []*ProcessData
+}
+
+// CustomData is the punctuator memory of one session
+type CustomData struct {
+	PartialResult string
+	Segments      []*Segments
+}
+
+// Words returns the count of kept words
+func (d *CustomData) Words() int {
+	res := 0
+	for _, s := range d.Segments {
+		res += len(s.Processed)
+	}
+	return res
+}
+
+// Evict drops the oldest segments not needed to hold the last keepWords final words.
+// The segment with the keepWords-th final word from the end and all later ones are kept.
+// Returns the count of dropped segments
+func (d *CustomData) Evict(keepWords int) int {
+	words := 0
+	for i := len(d.Segments) - 1; i > 0; i-- {
+		if d.Segments[i].Final {
+			words += len(d.Segments[i].Processed)
+		}
+		if words >= keepWords {
+			d.Segments = append([]*Segments(nil), d.Segments[i:]...)
+			return i
+		}
+	}
+	return 0
+}